@@ -0,0 +1,288 @@
+package ezpack
+
+import (
+	"fmt"
+	"math"
+)
+
+// AppendEncode appends the encoding of o, which must be a struct or a pointer
+// to one, to dst and returns the extended buffer. The size of the encoding is
+// computed first, so dst grows at most once. The bytes appended are identical
+// to those returned by Encode
+func AppendEncode(dst []byte, o interface{}) (res []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("recovered panic in AppendEncode: %s", r)
+		}
+	}()
+
+	// Take the value of the interface{} object, dereferencing once if passed
+	// a pointer
+	v := topLevelValue(o)
+
+	// Convert v (should be struct) to PackMap, our internal representation of a
+	// msgpack map
+	mte, err := structToPackMap(v, newEncodeState())
+	if err != nil {
+		return nil, err
+	}
+
+	return appendPackValue(dst, mte)
+}
+
+// appendPackValue appends the encoding of pv to dst, growing dst at most once
+func appendPackValue(dst []byte, pv PackValue) ([]byte, error) {
+	// Compute the exact size of the encoding
+	n, err := pv.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	// Make room for it all at once
+	if cap(dst)-len(dst) < n {
+		grown := make([]byte, len(dst), len(dst)+n)
+		copy(grown, dst)
+		dst = grown
+	}
+
+	return pv.AppendTo(dst)
+}
+
+// addSize adds two encoding sizes, ensuring the total won't cause problems for
+// 32-bit system ints
+func addSize(a, b int) (int, error) {
+	if (a < 0) || (b < 0) || (a > math.MaxInt32-b) {
+		return 0, ErrOverflow
+	}
+
+	return a + b, nil
+}
+
+// appendHeader appends the 5 byte header used by variable length types: a type
+// identifier followed by a big endian length
+func appendHeader(dst []byte, id byte, length int) ([]byte, error) {
+	// Ensure the length fits, even on 32-bit systems
+	if (length < 0) || (length > math.MaxInt32) {
+		return nil, ErrOverflow
+	}
+
+	return appendUint32(append(dst, id), uint32(length)), nil
+}
+
+// appendUint32 appends the big endian encoding of x to dst
+func appendUint32(dst []byte, x uint32) []byte {
+	return append(dst, byte(x>>24), byte(x>>16), byte(x>>8), byte(x))
+}
+
+// appendUint64 appends the big endian encoding of x to dst
+func appendUint64(dst []byte, x uint64) []byte {
+	return appendUint32(appendUint32(dst, uint32(x>>32)), uint32(x))
+}
+
+func (pv PackNil) Size() (int, error) {
+	return 1, nil
+}
+
+func (pv PackNil) AppendTo(dst []byte) ([]byte, error) {
+	return append(dst, PackNilID), nil
+}
+
+func (pv PackUint64) Size() (int, error) {
+	return 9, nil
+}
+
+func (pv PackUint64) AppendTo(dst []byte) ([]byte, error) {
+	return appendUint64(append(dst, PackUint64ID), pv.Value), nil
+}
+
+func (pv PackInt64) Size() (int, error) {
+	return 9, nil
+}
+
+func (pv PackInt64) AppendTo(dst []byte) ([]byte, error) {
+	return appendUint64(append(dst, PackInt64ID), uint64(pv.Value)), nil
+}
+
+func (pv PackBool) Size() (int, error) {
+	return 1, nil
+}
+
+func (pv PackBool) AppendTo(dst []byte) ([]byte, error) {
+	if pv.Value {
+		return append(dst, PackTrueID), nil
+	}
+	return append(dst, PackFalseID), nil
+}
+
+func (pv PackFloat32) Size() (int, error) {
+	return 5, nil
+}
+
+func (pv PackFloat32) AppendTo(dst []byte) ([]byte, error) {
+	// NaN is made canonical
+	bits := math.Float32bits(pv.Value)
+	if math.IsNaN(float64(pv.Value)) {
+		bits = CanonicalNaN32
+	}
+
+	return appendUint32(append(dst, PackFloat32ID), bits), nil
+}
+
+func (pv PackFloat64) Size() (int, error) {
+	return 9, nil
+}
+
+func (pv PackFloat64) AppendTo(dst []byte) ([]byte, error) {
+	// NaN is made canonical
+	bits := math.Float64bits(pv.Value)
+	if math.IsNaN(pv.Value) {
+		bits = CanonicalNaN64
+	}
+
+	return appendUint64(append(dst, PackFloat64ID), bits), nil
+}
+
+func (pv PackTimestamp) Size() (int, error) {
+	// Ensure nanoseconds are in range, so that Size fails whenever encoding
+	// would
+	if pv.Nanoseconds >= 1e9 {
+		return 0, fmt.Errorf("timestamp nanoseconds %d out of range", pv.Nanoseconds)
+	}
+
+	return 3 + PackTimestampLen, nil
+}
+
+func (pv PackTimestamp) AppendTo(dst []byte) ([]byte, error) {
+	// Ensure nanoseconds are in range
+	if pv.Nanoseconds >= 1e9 {
+		return nil, fmt.Errorf("timestamp nanoseconds %d out of range", pv.Nanoseconds)
+	}
+
+	dst = append(dst, PackExt8ID, PackTimestampLen, PackTimestampExtType&0xFF)
+	dst = appendUint32(dst, pv.Nanoseconds)
+	return appendUint64(dst, uint64(pv.Seconds)), nil
+}
+
+func (pv PackExt) Size() (int, error) {
+	return addSize(6, len(pv.Data))
+}
+
+func (pv PackExt) AppendTo(dst []byte) ([]byte, error) {
+	dst, err := appendHeader(dst, PackExt32ID, len(pv.Data))
+	if err != nil {
+		return nil, err
+	}
+
+	return append(append(dst, byte(pv.Type)), pv.Data...), nil
+}
+
+func (pv PackBytes) Size() (int, error) {
+	return addSize(5, len(pv.Bytes))
+}
+
+func (pv PackBytes) AppendTo(dst []byte) ([]byte, error) {
+	dst, err := appendHeader(dst, PackBytesID, len(pv.Bytes))
+	if err != nil {
+		return nil, err
+	}
+
+	return append(dst, pv.Bytes...), nil
+}
+
+func (pv PackString) Size() (int, error) {
+	return addSize(5, len(pv.String))
+}
+
+func (pv PackString) AppendTo(dst []byte) ([]byte, error) {
+	dst, err := appendHeader(dst, PackStringID, len(pv.String))
+	if err != nil {
+		return nil, err
+	}
+
+	return append(dst, pv.String...), nil
+}
+
+func (pv PackValueSlice) Size() (int, error) {
+	// Header, then each value
+	n := 5
+	for _, elt := range pv.Values {
+		en, err := elt.Size()
+		if err != nil {
+			return 0, err
+		}
+
+		n, err = addSize(n, en)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return n, nil
+}
+
+func (pv PackValueSlice) AppendTo(dst []byte) ([]byte, error) {
+	dst, err := appendHeader(dst, PackArrayID, len(pv.Values))
+	if err != nil {
+		return nil, err
+	}
+
+	// Append each value in turn
+	for _, elt := range pv.Values {
+		dst, err = elt.AppendTo(dst)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return dst, nil
+}
+
+func (pv PackMap) Size() (int, error) {
+	// Header, then each key and value
+	n := 5
+	for _, elt := range pv.Elements {
+		kn, err := elt.Key.Size()
+		if err != nil {
+			return 0, err
+		}
+
+		vn, err := elt.Value.Size()
+		if err != nil {
+			return 0, err
+		}
+
+		n, err = addSize(n, kn)
+		if err != nil {
+			return 0, err
+		}
+
+		n, err = addSize(n, vn)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return n, nil
+}
+
+func (pv PackMap) AppendTo(dst []byte) ([]byte, error) {
+	dst, err := appendHeader(dst, PackMapID, len(pv.Elements))
+	if err != nil {
+		return nil, err
+	}
+
+	// Append each key and value in turn
+	for _, elt := range pv.Elements {
+		dst, err = elt.Key.AppendTo(dst)
+		if err != nil {
+			return nil, err
+		}
+
+		dst, err = elt.Value.AppendTo(dst)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return dst, nil
+}
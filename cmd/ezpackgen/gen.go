@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/types"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/justicz/ezpack/genhelp"
+)
+
+// fieldKind says how the generated code handles a field
+type fieldKind int
+
+const (
+	// kindFallback fields are handled by genhelp.EncodeField and
+	// genhelp.DecodeField
+	kindFallback fieldKind = iota
+	kindBool
+	kindString
+	kindBytes
+	kindUint
+	kindInt
+
+	// kindGenerated fields have a type we are also generating code for, whose
+	// methods can be called directly
+	kindGenerated
+)
+
+// intKinds maps each integer type to its reflect.Kind name
+var intKinds = map[string]string{
+	"int":    "Int",
+	"int8":   "Int8",
+	"int16":  "Int16",
+	"int32":  "Int32",
+	"int64":  "Int64",
+	"uint":   "Uint",
+	"uint8":  "Uint8",
+	"byte":   "Uint8",
+	"uint16": "Uint16",
+	"uint32": "Uint32",
+	"uint64": "Uint64",
+}
+
+// genField is a struct field we are generating code for
+type genField struct {
+	goName string
+	goType string
+	tag    string
+	info   genhelp.TagInfo
+	kind   fieldKind
+}
+
+// genStruct is a struct type we are generating code for
+type genStruct struct {
+	name   string
+	fields []genField
+}
+
+// loadStruct finds the struct type name in pkg and works out how to handle
+// each of its fields, sorted by name on the wire. direct holds the names of the
+// types we are generating code for whose methods fields can call directly
+func loadStruct(pkg *ast.Package, name string, direct map[string]bool) (*genStruct, error) {
+	st := findStruct(pkg, name)
+	if st == nil {
+		return nil, fmt.Errorf("no struct type %s in package %s", name, pkg.Name)
+	}
+
+	gs := &genStruct{
+		name: name,
+	}
+
+	for _, field := range st.Fields.List {
+		// Fetch the raw struct tag
+		var tag string
+		if field.Tag != nil {
+			var err error
+			tag, err = strconv.Unquote(field.Tag.Value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad struct tag %s", name, field.Tag.Value)
+			}
+		}
+
+		// Embedded fields are named after their type
+		goNames := make([]string, 0, len(field.Names))
+		for _, ident := range field.Names {
+			goNames = append(goNames, ident.Name)
+		}
+		if len(goNames) == 0 {
+			goNames = append(goNames, embeddedName(field.Type))
+		}
+
+		for _, goName := range goNames {
+			// Parse the struct tag, reporting the same errors as Encode and
+			// Decode would
+			info, err := genhelp.ParseTag(tag, goName)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err)
+			}
+
+			if info.Skip {
+				continue
+			}
+
+			if info.Inline {
+				return nil, fmt.Errorf("%s: inline field '%s' is not supported", name, goName)
+			}
+
+			if !ast.IsExported(goName) {
+				return nil, fmt.Errorf("%s: unexported field '%s' must be exported or tagged with ezpack:\"-\"", name, goName)
+			}
+
+			gs.fields = append(gs.fields, genField{
+				goName: goName,
+				goType: types.ExprString(field.Type),
+				tag:    tag,
+				info:   info,
+				kind:   classify(field.Type, info, direct),
+			})
+		}
+	}
+
+	// Sort fields by name on the wire, and check for duplicates like the
+	// reflection-based codec does
+	sort.Slice(gs.fields, func(i, j int) bool {
+		return gs.fields[i].info.Name < gs.fields[j].info.Name
+	})
+
+	for i := 1; i < len(gs.fields); i++ {
+		if gs.fields[i].info.Name == gs.fields[i-1].info.Name {
+			return nil, fmt.Errorf("%s: found duplicate key '%s'", name, gs.fields[i].info.Name)
+		}
+	}
+
+	return gs, nil
+}
+
+// embeddedName returns the field name of an embedded field of type expr
+func embeddedName(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return embeddedName(t.X)
+	case *ast.SelectorExpr:
+		return t.Sel.Name
+	case *ast.Ident:
+		return t.Name
+	default:
+		return ""
+	}
+}
+
+// classify works out how the generated code should handle a field of type
+// expr. Only unnamed types and the types in direct are handled inline, since
+// any other type could have codec hooks
+func classify(expr ast.Expr, info genhelp.TagInfo, direct map[string]bool) fieldKind {
+	if info.HasOptions {
+		return kindFallback
+	}
+
+	switch t := expr.(type) {
+	case *ast.Ident:
+		switch {
+		case t.Name == "bool":
+			return kindBool
+		case t.Name == "string":
+			return kindString
+		case strings.HasPrefix(intKinds[t.Name], "Uint"):
+			return kindUint
+		case intKinds[t.Name] != "":
+			return kindInt
+		case direct[t.Name]:
+			return kindGenerated
+		}
+	case *ast.ArrayType:
+		elem, ok := t.Elt.(*ast.Ident)
+		if t.Len == nil && ok && (elem.Name == "byte" || elem.Name == "uint8") {
+			return kindBytes
+		}
+	}
+
+	return kindFallback
+}
+
+// mayHaveCodecHooks reports whether the struct type name in pkg might implement
+// Marshaler or Unmarshaler: either it has a MarshalEzpack or UnmarshalEzpack
+// method, or it has embedded fields, which could promote one
+func mayHaveCodecHooks(pkg *ast.Package, name string) bool {
+	st := findStruct(pkg, name)
+	if st != nil {
+		for _, field := range st.Fields.List {
+			if len(field.Names) == 0 {
+				return true
+			}
+		}
+	}
+
+	for _, file := range pkg.Files {
+		for _, decl := range file.Decls {
+			fd, ok := decl.(*ast.FuncDecl)
+			if !ok || fd.Recv == nil || len(fd.Recv.List) == 0 {
+				continue
+			}
+
+			if fd.Name.Name != "MarshalEzpack" && fd.Name.Name != "UnmarshalEzpack" {
+				continue
+			}
+
+			if embeddedName(fd.Recv.List[0].Type) == name {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// loadStructs loads each of the types we are generating code for
+func loadStructs(pkg *ast.Package, typeNames []string) ([]*genStruct, error) {
+	generated := make(map[string]bool)
+	for _, name := range typeNames {
+		if generated[name] {
+			return nil, fmt.Errorf("type %s given twice", name)
+		}
+		generated[name] = true
+	}
+
+	// Reflection checks for Marshaler and Unmarshaler before encoding a struct
+	// field by its fields, so fields can only call the generated methods of
+	// types that can't implement them
+	direct := make(map[string]bool)
+	for name := range generated {
+		direct[name] = !mayHaveCodecHooks(pkg, name)
+	}
+
+	structs := make([]*genStruct, 0, len(typeNames))
+	for _, name := range typeNames {
+		gs, err := loadStruct(pkg, name, direct)
+		if err != nil {
+			return nil, err
+		}
+		structs = append(structs, gs)
+	}
+
+	return structs, nil
+}
+
+// generate returns the formatted source of the EncodeEzpack and DecodeEzpack
+// methods for the types named typeNames
+func generate(pkg *ast.Package, typeNames []string) ([]byte, error) {
+	structs, err := loadStructs(pkg, typeNames)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only import what the generated code uses
+	var usesFmt, usesReflect bool
+	for _, gs := range structs {
+		for _, field := range gs.fields {
+			usesFmt = true
+			if field.kind == kindUint || field.kind == kindInt {
+				usesReflect = true
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by ezpackgen. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "package %s\n\n", pkg.Name)
+	fmt.Fprintf(&buf, "import (\n")
+	if usesFmt {
+		fmt.Fprintf(&buf, "\t\"fmt\"\n")
+	}
+	fmt.Fprintf(&buf, "\t\"io\"\n")
+	if usesReflect {
+		fmt.Fprintf(&buf, "\t\"reflect\"\n")
+	}
+	fmt.Fprintf(&buf, "\n\t\"github.com/justicz/ezpack\"\n")
+	fmt.Fprintf(&buf, "\t\"github.com/justicz/ezpack/genhelp\"\n)\n")
+
+	for _, gs := range structs {
+		writeEncode(&buf, gs)
+		writeDecode(&buf, gs)
+	}
+
+	return formatSource(buf.Bytes())
+}
+
+// quoteTag returns a Go string literal for tag, preferring a raw string like
+// the struct definition probably used
+func quoteTag(tag string) string {
+	if strings.ContainsAny(tag, "`\r") {
+		return strconv.Quote(tag)
+	}
+
+	return "`" + tag + "`"
+}
+
+// formatSource gofmts src, reporting a bug if it doesn't parse
+func formatSource(src []byte) ([]byte, error) {
+	formatted, err := format.Source(src)
+	if err != nil {
+		return nil, fmt.Errorf("generated invalid code (this is a bug): %s", err)
+	}
+
+	return formatted, nil
+}
+
+// writeEncode writes the EncodeEzpack method for gs
+func writeEncode(buf *bytes.Buffer, gs *genStruct) {
+	fmt.Fprintf(buf, "\n// EncodeEzpack is used by ezpack.Encode in place of reflection\n")
+	fmt.Fprintf(buf, "func (x %s) EncodeEzpack(es genhelp.EncodeState) (*ezpack.PackMap, error) {\n", gs.name)
+
+	// Only declare the variables we need
+	needsErr := false
+	for _, field := range gs.fields {
+		if field.kind == kindFallback || field.kind == kindGenerated {
+			needsErr = true
+		}
+	}
+	if needsErr {
+		fmt.Fprintf(buf, "var pv ezpack.PackValue\nvar err error\n")
+	}
+
+	fmt.Fprintf(buf, "elements := make([]ezpack.PackMapElement, %d)\n", len(gs.fields))
+
+	for i, field := range gs.fields {
+		name := strconv.Quote(field.info.Name)
+		fmt.Fprintf(buf, "\n// %s\n", field.goName)
+		fmt.Fprintf(buf, "elements[%d].Key = ezpack.PackString{String: %s}\n", i, name)
+
+		switch field.kind {
+		case kindBool:
+			fmt.Fprintf(buf, "elements[%d].Value = ezpack.PackBool{Value: x.%s}\n", i, field.goName)
+		case kindString:
+			fmt.Fprintf(buf, "elements[%d].Value = ezpack.PackString{String: x.%s}\n", i, field.goName)
+		case kindBytes:
+			fmt.Fprintf(buf, "elements[%d].Value = ezpack.PackBytes{Bytes: x.%s}\n", i, field.goName)
+		case kindUint:
+			fmt.Fprintf(buf, "elements[%d].Value = ezpack.PackUint64{Value: uint64(x.%s)}\n", i, field.goName)
+		case kindInt:
+			fmt.Fprintf(buf, "elements[%d].Value = ezpack.PackInt64{Value: int64(x.%s)}\n", i, field.goName)
+		case kindGenerated, kindFallback:
+			if field.kind == kindGenerated {
+				fmt.Fprintf(buf, "pv, err = x.%s.EncodeEzpack(es)\n", field.goName)
+			} else {
+				fmt.Fprintf(buf, "pv, err = genhelp.EncodeField(es, &x.%s, %s)\n", field.goName, quoteTag(field.tag))
+			}
+			fmt.Fprintf(buf, "if err != nil {\n")
+			fmt.Fprintf(buf, "return nil, fmt.Errorf(\"error encoding '%%s': %%w\", %s, err)\n", name)
+			fmt.Fprintf(buf, "}\n")
+			fmt.Fprintf(buf, "elements[%d].Value = pv\n", i)
+		}
+	}
+
+	fmt.Fprintf(buf, "\nreturn &ezpack.PackMap{Elements: elements}, nil\n}\n")
+}
+
+// writeDecode writes the DecodeEzpack method for gs
+func writeDecode(buf *bytes.Buffer, gs *genStruct) {
+	fmt.Fprintf(buf, "\n// DecodeEzpack is used by ezpack.Decode in place of reflection\n")
+	fmt.Fprintf(buf, "func (x *%s) DecodeEzpack(ds genhelp.DecodeState, r io.Reader) error {\n", gs.name)
+	fmt.Fprintf(buf, "err := genhelp.ReadStructHeader(r, %s, %d)\n", strconv.Quote(gs.name), len(gs.fields))
+	fmt.Fprintf(buf, "if err != nil {\nreturn err\n}\n")
+
+	for i, field := range gs.fields {
+		name := strconv.Quote(field.info.Name)
+		wrap := fmt.Sprintf("if err != nil {\nreturn fmt.Errorf(\"error decoding '%%s': %%w\", %s, err)\n}\n", name)
+
+		fmt.Fprintf(buf, "\n// %s\n", field.goName)
+		fmt.Fprintf(buf, "err = genhelp.ReadFieldName(r, %s)\n", name)
+		fmt.Fprintf(buf, "if err != nil {\nreturn err\n}\n")
+
+		// Decode scalars into a temporary first, so that the field is left
+		// alone on error like the reflection-based decoder does
+		var call, conv string
+		switch field.kind {
+		case kindBool:
+			call, conv = "genhelp.ReadBool(r)", "v%d"
+		case kindString:
+			call, conv = fmt.Sprintf("genhelp.ReadString(r, %d)", field.info.MaxLen), "v%d"
+		case kindBytes:
+			call, conv = fmt.Sprintf("genhelp.ReadBytes(r, %d)", field.info.MaxLen), "v%d"
+		case kindUint:
+			call, conv = fmt.Sprintf("genhelp.ReadUint(r, reflect.%s)", intKinds[field.goType]), field.goType+"(v%d)"
+		case kindInt:
+			call, conv = fmt.Sprintf("genhelp.ReadInt(r, reflect.%s)", intKinds[field.goType]), field.goType+"(v%d)"
+		case kindGenerated:
+			fmt.Fprintf(buf, "err = x.%s.DecodeEzpack(ds, r)\n%s", field.goName, wrap)
+			continue
+		case kindFallback:
+			fmt.Fprintf(buf, "err = genhelp.DecodeField(ds, r, &x.%s, %s)\n%s", field.goName, quoteTag(field.tag), wrap)
+			continue
+		}
+
+		fmt.Fprintf(buf, "v%d, err := %s\n%s", i, call, wrap)
+		fmt.Fprintf(buf, "x.%s = %s\n", field.goName, fmt.Sprintf(conv, i))
+	}
+
+	fmt.Fprintf(buf, "\nreturn nil\n}\n")
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeneratedExampleIsUpToDate(t *testing.T) {
+	dir := filepath.Join("internal", "example")
+	types := []string{"Player", "Position", "Node", "Drawing", "Money", "Order"}
+
+	pkg, err := parsePackage(dir, types)
+	require.NoError(t, err)
+
+	src, err := generate(pkg, types)
+	require.NoError(t, err)
+	want, err := ioutil.ReadFile(filepath.Join(dir, "player_ezpack.go"))
+	require.NoError(t, err)
+	require.Equal(t, string(want), string(src), "run go generate in %s", dir)
+
+	testSrc, err := generateTest(pkg, types)
+	require.NoError(t, err)
+	want, err = ioutil.ReadFile(filepath.Join(dir, "player_ezpack_test.go"))
+	require.NoError(t, err)
+	require.Equal(t, string(want), string(testSrc), "run go generate in %s", dir)
+}
+
+func TestGenerateRejectsUnsupportedStructs(t *testing.T) {
+	for src, wantErr := range map[string]string{
+		"type T struct {\n\tfoo string `ezpack:\"foo\"`\n}":                            "T: unexported field 'foo' must be exported or tagged with ezpack:\"-\"",
+		"type T struct {\n\tA string `ezpack:\"a\"`\n\tB string `ezpack:\"a\"`\n}":     "T: found duplicate key 'a'",
+		"type T struct {\n\tA string\n}":                                               "T: valid ezpack struct tag required on 'A'",
+		"type Base struct{}\n\ntype T struct {\n\tBase `ezpack:\",inline\"`\n}":        "T: inline field 'Base' is not supported",
+		"type T struct {\n\tA string `ezpack:\"a\"`\n}\n\ntype U struct {\n\tB int\n}": "no struct type V in package p",
+	} {
+		dir, err := ioutil.TempDir("", "ezpackgen")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		err = ioutil.WriteFile(filepath.Join(dir, "p.go"), []byte("package p\n\n"+src+"\n"), 0644)
+		require.NoError(t, err)
+
+		pkg, err := parsePackage(dir, []string{"T"})
+		require.NoError(t, err)
+
+		// V never exists, so it is only reported once T is accepted
+		_, err = generate(pkg, []string{"T", "V"})
+		require.EqualError(t, err, wantErr, src)
+	}
+}
+
+func TestGenerateFallsBackForCodecHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ezpackgen")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// U only has UnmarshalEzpack, and E could promote methods from Base
+	src := `package p
+
+import "github.com/justicz/ezpack"
+
+type Base struct{}
+
+type U struct{}
+
+func (u *U) UnmarshalEzpack(pv ezpack.PackValue) error { return nil }
+
+type E struct {
+	Base ` + "`ezpack:\"base\"`" + `
+}
+
+type Plain struct{}
+
+type T struct {
+	U     U     ` + "`ezpack:\"u\"`" + `
+	E     E     ` + "`ezpack:\"e\"`" + `
+	Plain Plain ` + "`ezpack:\"plain\"`" + `
+}
+`
+	err = ioutil.WriteFile(filepath.Join(dir, "p.go"), []byte(src), 0644)
+	require.NoError(t, err)
+
+	types := []string{"T", "U", "E", "Plain"}
+	pkg, err := parsePackage(dir, types)
+	require.NoError(t, err)
+
+	code, err := generate(pkg, types)
+	require.NoError(t, err)
+	require.Contains(t, string(code), "genhelp.EncodeField(es, &x.U, ")
+	require.Contains(t, string(code), "genhelp.EncodeField(es, &x.E, ")
+	require.Contains(t, string(code), "x.Plain.EncodeEzpack(es)")
+}
+
+func TestRunWritesCodeAndTest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ezpackgen")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := "package p\n\ntype T struct {\n\tA []byte `ezpack:\"a,4\"`\n}\n"
+	err = ioutil.WriteFile(filepath.Join(dir, "p.go"), []byte(src), 0644)
+	require.NoError(t, err)
+
+	out := filepath.Join(dir, "t_ezpack.go")
+	err = run(dir, []string{"T"}, out, true)
+	require.NoError(t, err)
+	require.FileExists(t, out)
+	require.FileExists(t, filepath.Join(dir, "t_ezpack_test.go"))
+
+	// Regenerating should ignore the test file, and -notest shouldn't write it
+	err = os.Remove(filepath.Join(dir, "t_ezpack_test.go"))
+	require.NoError(t, err)
+	err = run(dir, []string{"T"}, out, false)
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, "t_ezpack_test.go"))
+	require.True(t, os.IsNotExist(err))
+}
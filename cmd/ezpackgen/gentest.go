@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+)
+
+// testHelpers are written once per generated test file. %[1]s is a suffix
+// that keeps the names distinct from those of other generated test files in
+// the same package
+const testHelpers = `
+// ezpackgenRandom%[1]s returns a random value of type t, or false if
+// testing/quick can't generate one (e.g. because t has unexported fields)
+func ezpackgenRandom%[1]s(t reflect.Type, rng *rand.Rand) (v reflect.Value, ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+
+	return quick.Value(t, rng)
+}
+
+// ezpackgenCheck%[1]s fails the test unless the generated code and the
+// reflection-based codec agreed
+func ezpackgenCheck%[1]s(t *testing.T, what string, gen []byte, genErr error, ref []byte, refErr error) {
+	t.Helper()
+
+	if (genErr == nil) != (refErr == nil) || (genErr != nil && genErr.Error() != refErr.Error()) {
+		t.Fatalf("%%s: generated code returned error %%v, reflection returned %%v", what, genErr, refErr)
+	}
+
+	if !bytes.Equal(gen, ref) {
+		t.Fatalf("%%s: generated code produced %%x, reflection produced %%x", what, gen, ref)
+	}
+}
+`
+
+// typeTest is written for each type. %[1]s is the type name and %[2]s is the
+// helper suffix
+const typeTest = `
+func TestEzpackgen%[1]s(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		rv, ok := ezpackgenRandom%[2]s(reflect.TypeOf(%[1]s{}), rng)
+		if !ok {
+			t.Skip("cannot generate random %[1]s values")
+		}
+		x := rv.Interface().(%[1]s)
+
+		// Encoding must produce the same bytes or error. With generated code
+		// disabled, nested types with generated code use reflection too
+		gen, genErr := ezpack.Encode(x)
+		var ref []byte
+		var refErr error
+		genhelp.WithReflection(func() {
+			ref, refErr = ezpack.Encode(x)
+		})
+		ezpackgenCheck%[2]s(t, "Encode", gen, genErr, ref, refErr)
+		if genErr != nil {
+			continue
+		}
+
+		// Decoding must succeed or fail the same way
+		var genDec, refDec %[1]s
+		genErr = ezpack.DecodeBytes(gen, &genDec)
+		genhelp.WithReflection(func() {
+			refErr = ezpack.DecodeBytes(gen, &refDec)
+		})
+		ezpackgenCheck%[2]s(t, "Decode", nil, genErr, nil, refErr)
+		if genErr != nil {
+			continue
+		}
+
+		// And produce the same values, which we compare by encoding them again
+		// since random floats may be NaN
+		gen, genErr = ezpack.Encode(genDec)
+		ref, refErr = ezpack.Encode(refDec)
+		ezpackgenCheck%[2]s(t, "Encode after Decode", gen, genErr, ref, refErr)
+	}
+}
+`
+
+// generateTest returns the formatted source of a test checking that the code
+// generated for types agrees with the reflection-based codec
+func generateTest(pkg *ast.Package, types []string) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by ezpackgen. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "package %s\n\n", pkg.Name)
+	fmt.Fprintf(&buf, "import (\n")
+	for _, imp := range []string{"bytes", "math/rand", "reflect", "testing", "testing/quick", "", "github.com/justicz/ezpack", "github.com/justicz/ezpack/genhelp"} {
+		if imp == "" {
+			fmt.Fprintf(&buf, "\n")
+			continue
+		}
+		fmt.Fprintf(&buf, "\t%q\n", imp)
+	}
+	fmt.Fprintf(&buf, ")\n")
+
+	suffix := types[0]
+	fmt.Fprintf(&buf, testHelpers, suffix)
+	for _, name := range types {
+		fmt.Fprintf(&buf, typeTest, name, suffix)
+	}
+
+	return formatSource(buf.Bytes())
+}
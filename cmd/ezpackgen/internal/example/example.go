@@ -0,0 +1,91 @@
+// Package example holds types with code generated by ezpackgen, so that the
+// generated code is built and tested along with everything else
+package example
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/justicz/ezpack"
+)
+
+//go:generate go run github.com/justicz/ezpack/cmd/ezpackgen -type Player,Position,Node,Drawing,Money,Order
+
+// Player has each kind of field ezpackgen handles
+type Player struct {
+	Name     string   `ezpack:"name,32"`
+	ID       uint64   `ezpack:"id"`
+	Count    uint16   `ezpack:"count"`
+	Level    int8     `ezpack:"level"`
+	Online   bool     `ezpack:"online"`
+	Avatar   []byte   `ezpack:"avatar,64"`
+	Position Position `ezpack:"pos"`
+	Friends  []string `ezpack:"friends,4,elemlen=32"`
+	Score    float64  `ezpack:"score,normfloat"`
+	Cache    string   `ezpack:"-"`
+}
+
+// Position is nested in Player
+type Position struct {
+	X int32 `ezpack:"x"`
+	Y int32 `ezpack:"y"`
+}
+
+// Node can form a cycle through Next
+type Node struct {
+	Next  *Node  `ezpack:"next"`
+	Value uint64 `ezpack:"value"`
+}
+
+// Shape is a union of the shapes a Drawing can hold
+type Shape interface {
+	isShape()
+}
+
+// Circle is a Shape
+type Circle struct {
+	Radius uint32 `ezpack:"radius"`
+}
+
+func (Circle) isShape() {}
+
+func init() {
+	err := ezpack.RegisterUnion(reflect.TypeOf((*Shape)(nil)).Elem(), map[string]reflect.Type{
+		"circle": reflect.TypeOf(Circle{}),
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Drawing has union fields, which generated code must pass to reflection with
+// their static type
+type Drawing struct {
+	Main  Shape `ezpack:"main,union"`
+	Extra Shape `ezpack:"extra,union"`
+}
+
+// Money has its own Marshaler, which reflection uses in place of Money's
+// fields when Money is a field, so generated code must too
+type Money struct {
+	Cents uint64 `ezpack:"cents"`
+}
+
+func (m Money) MarshalEzpack() (ezpack.PackValue, error) {
+	return ezpack.PackUint64{Value: m.Cents}, nil
+}
+
+func (m *Money) UnmarshalEzpack(pv ezpack.PackValue) error {
+	u, ok := pv.(ezpack.PackUint64)
+	if !ok {
+		return fmt.Errorf("money must be a uint64, not %T", pv)
+	}
+	m.Cents = u.Value
+	return nil
+}
+
+// Order holds a Money
+type Order struct {
+	Price    Money  `ezpack:"price"`
+	Quantity uint16 `ezpack:"quantity"`
+}
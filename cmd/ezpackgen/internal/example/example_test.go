@@ -0,0 +1,73 @@
+package example
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/justicz/ezpack"
+	"github.com/justicz/ezpack/genhelp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeneratedCodeDetectsCycles(t *testing.T) {
+	n := &Node{Value: 1}
+	n.Next = &Node{Value: 2, Next: n}
+
+	_, err := ezpack.Encode(n)
+	require.Error(t, err)
+
+	// The error should be the same as with reflection
+	genhelp.WithReflection(func() {
+		_, refErr := ezpack.Encode(n)
+		require.Error(t, refErr)
+		require.Equal(t, refErr.Error(), err.Error())
+	})
+	require.Contains(t, err.Error(), "cycle detected through *example.Node")
+}
+
+func TestGeneratedCodeIsUsedForNestedTypes(t *testing.T) {
+	p := Player{Name: "ann", Avatar: []byte{}, Position: Position{X: 1, Y: -1}, Friends: []string{"bob"}}
+
+	enc, err := ezpack.Encode(p)
+	require.NoError(t, err)
+
+	var res Player
+	err = ezpack.DecodeBytes(enc, &res)
+	require.NoError(t, err)
+	require.Equal(t, p, res)
+}
+
+func TestGeneratedCodeBoundsDepth(t *testing.T) {
+	n := &Node{}
+	for i := 0; i < 1000; i++ {
+		n = &Node{Next: n}
+	}
+
+	enc, err := ezpack.Encode(n)
+	require.NoError(t, err)
+
+	var res Node
+	err = ezpack.DecodeBytes(enc, &res)
+	require.True(t, errors.Is(err, ezpack.ErrMaxDepth), "%v", err)
+}
+
+func TestGeneratedCodeHandlesUnionFields(t *testing.T) {
+	for _, d := range []Drawing{
+		Drawing{Main: Circle{Radius: 2}},
+		Drawing{},
+	} {
+		enc, err := ezpack.Encode(d)
+		require.NoError(t, err)
+
+		genhelp.WithReflection(func() {
+			ref, err := ezpack.Encode(d)
+			require.NoError(t, err)
+			require.Equal(t, ref, enc)
+		})
+
+		var res Drawing
+		err = ezpack.DecodeBytes(enc, &res)
+		require.NoError(t, err)
+		require.Equal(t, d, res)
+	}
+}
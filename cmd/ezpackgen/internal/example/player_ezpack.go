@@ -0,0 +1,413 @@
+// Code generated by ezpackgen. DO NOT EDIT.
+
+package example
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/justicz/ezpack"
+	"github.com/justicz/ezpack/genhelp"
+)
+
+// EncodeEzpack is used by ezpack.Encode in place of reflection
+func (x Player) EncodeEzpack(es genhelp.EncodeState) (*ezpack.PackMap, error) {
+	var pv ezpack.PackValue
+	var err error
+	elements := make([]ezpack.PackMapElement, 9)
+
+	// Avatar
+	elements[0].Key = ezpack.PackString{String: "avatar"}
+	elements[0].Value = ezpack.PackBytes{Bytes: x.Avatar}
+
+	// Count
+	elements[1].Key = ezpack.PackString{String: "count"}
+	elements[1].Value = ezpack.PackUint64{Value: uint64(x.Count)}
+
+	// Friends
+	elements[2].Key = ezpack.PackString{String: "friends"}
+	pv, err = genhelp.EncodeField(es, &x.Friends, `ezpack:"friends,4,elemlen=32"`)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding '%s': %w", "friends", err)
+	}
+	elements[2].Value = pv
+
+	// ID
+	elements[3].Key = ezpack.PackString{String: "id"}
+	elements[3].Value = ezpack.PackUint64{Value: uint64(x.ID)}
+
+	// Level
+	elements[4].Key = ezpack.PackString{String: "level"}
+	elements[4].Value = ezpack.PackInt64{Value: int64(x.Level)}
+
+	// Name
+	elements[5].Key = ezpack.PackString{String: "name"}
+	elements[5].Value = ezpack.PackString{String: x.Name}
+
+	// Online
+	elements[6].Key = ezpack.PackString{String: "online"}
+	elements[6].Value = ezpack.PackBool{Value: x.Online}
+
+	// Position
+	elements[7].Key = ezpack.PackString{String: "pos"}
+	pv, err = x.Position.EncodeEzpack(es)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding '%s': %w", "pos", err)
+	}
+	elements[7].Value = pv
+
+	// Score
+	elements[8].Key = ezpack.PackString{String: "score"}
+	pv, err = genhelp.EncodeField(es, &x.Score, `ezpack:"score,normfloat"`)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding '%s': %w", "score", err)
+	}
+	elements[8].Value = pv
+
+	return &ezpack.PackMap{Elements: elements}, nil
+}
+
+// DecodeEzpack is used by ezpack.Decode in place of reflection
+func (x *Player) DecodeEzpack(ds genhelp.DecodeState, r io.Reader) error {
+	err := genhelp.ReadStructHeader(r, "Player", 9)
+	if err != nil {
+		return err
+	}
+
+	// Avatar
+	err = genhelp.ReadFieldName(r, "avatar")
+	if err != nil {
+		return err
+	}
+	v0, err := genhelp.ReadBytes(r, 64)
+	if err != nil {
+		return fmt.Errorf("error decoding '%s': %w", "avatar", err)
+	}
+	x.Avatar = v0
+
+	// Count
+	err = genhelp.ReadFieldName(r, "count")
+	if err != nil {
+		return err
+	}
+	v1, err := genhelp.ReadUint(r, reflect.Uint16)
+	if err != nil {
+		return fmt.Errorf("error decoding '%s': %w", "count", err)
+	}
+	x.Count = uint16(v1)
+
+	// Friends
+	err = genhelp.ReadFieldName(r, "friends")
+	if err != nil {
+		return err
+	}
+	err = genhelp.DecodeField(ds, r, &x.Friends, `ezpack:"friends,4,elemlen=32"`)
+	if err != nil {
+		return fmt.Errorf("error decoding '%s': %w", "friends", err)
+	}
+
+	// ID
+	err = genhelp.ReadFieldName(r, "id")
+	if err != nil {
+		return err
+	}
+	v3, err := genhelp.ReadUint(r, reflect.Uint64)
+	if err != nil {
+		return fmt.Errorf("error decoding '%s': %w", "id", err)
+	}
+	x.ID = uint64(v3)
+
+	// Level
+	err = genhelp.ReadFieldName(r, "level")
+	if err != nil {
+		return err
+	}
+	v4, err := genhelp.ReadInt(r, reflect.Int8)
+	if err != nil {
+		return fmt.Errorf("error decoding '%s': %w", "level", err)
+	}
+	x.Level = int8(v4)
+
+	// Name
+	err = genhelp.ReadFieldName(r, "name")
+	if err != nil {
+		return err
+	}
+	v5, err := genhelp.ReadString(r, 32)
+	if err != nil {
+		return fmt.Errorf("error decoding '%s': %w", "name", err)
+	}
+	x.Name = v5
+
+	// Online
+	err = genhelp.ReadFieldName(r, "online")
+	if err != nil {
+		return err
+	}
+	v6, err := genhelp.ReadBool(r)
+	if err != nil {
+		return fmt.Errorf("error decoding '%s': %w", "online", err)
+	}
+	x.Online = v6
+
+	// Position
+	err = genhelp.ReadFieldName(r, "pos")
+	if err != nil {
+		return err
+	}
+	err = x.Position.DecodeEzpack(ds, r)
+	if err != nil {
+		return fmt.Errorf("error decoding '%s': %w", "pos", err)
+	}
+
+	// Score
+	err = genhelp.ReadFieldName(r, "score")
+	if err != nil {
+		return err
+	}
+	err = genhelp.DecodeField(ds, r, &x.Score, `ezpack:"score,normfloat"`)
+	if err != nil {
+		return fmt.Errorf("error decoding '%s': %w", "score", err)
+	}
+
+	return nil
+}
+
+// EncodeEzpack is used by ezpack.Encode in place of reflection
+func (x Position) EncodeEzpack(es genhelp.EncodeState) (*ezpack.PackMap, error) {
+	elements := make([]ezpack.PackMapElement, 2)
+
+	// X
+	elements[0].Key = ezpack.PackString{String: "x"}
+	elements[0].Value = ezpack.PackInt64{Value: int64(x.X)}
+
+	// Y
+	elements[1].Key = ezpack.PackString{String: "y"}
+	elements[1].Value = ezpack.PackInt64{Value: int64(x.Y)}
+
+	return &ezpack.PackMap{Elements: elements}, nil
+}
+
+// DecodeEzpack is used by ezpack.Decode in place of reflection
+func (x *Position) DecodeEzpack(ds genhelp.DecodeState, r io.Reader) error {
+	err := genhelp.ReadStructHeader(r, "Position", 2)
+	if err != nil {
+		return err
+	}
+
+	// X
+	err = genhelp.ReadFieldName(r, "x")
+	if err != nil {
+		return err
+	}
+	v0, err := genhelp.ReadInt(r, reflect.Int32)
+	if err != nil {
+		return fmt.Errorf("error decoding '%s': %w", "x", err)
+	}
+	x.X = int32(v0)
+
+	// Y
+	err = genhelp.ReadFieldName(r, "y")
+	if err != nil {
+		return err
+	}
+	v1, err := genhelp.ReadInt(r, reflect.Int32)
+	if err != nil {
+		return fmt.Errorf("error decoding '%s': %w", "y", err)
+	}
+	x.Y = int32(v1)
+
+	return nil
+}
+
+// EncodeEzpack is used by ezpack.Encode in place of reflection
+func (x Node) EncodeEzpack(es genhelp.EncodeState) (*ezpack.PackMap, error) {
+	var pv ezpack.PackValue
+	var err error
+	elements := make([]ezpack.PackMapElement, 2)
+
+	// Next
+	elements[0].Key = ezpack.PackString{String: "next"}
+	pv, err = genhelp.EncodeField(es, &x.Next, `ezpack:"next"`)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding '%s': %w", "next", err)
+	}
+	elements[0].Value = pv
+
+	// Value
+	elements[1].Key = ezpack.PackString{String: "value"}
+	elements[1].Value = ezpack.PackUint64{Value: uint64(x.Value)}
+
+	return &ezpack.PackMap{Elements: elements}, nil
+}
+
+// DecodeEzpack is used by ezpack.Decode in place of reflection
+func (x *Node) DecodeEzpack(ds genhelp.DecodeState, r io.Reader) error {
+	err := genhelp.ReadStructHeader(r, "Node", 2)
+	if err != nil {
+		return err
+	}
+
+	// Next
+	err = genhelp.ReadFieldName(r, "next")
+	if err != nil {
+		return err
+	}
+	err = genhelp.DecodeField(ds, r, &x.Next, `ezpack:"next"`)
+	if err != nil {
+		return fmt.Errorf("error decoding '%s': %w", "next", err)
+	}
+
+	// Value
+	err = genhelp.ReadFieldName(r, "value")
+	if err != nil {
+		return err
+	}
+	v1, err := genhelp.ReadUint(r, reflect.Uint64)
+	if err != nil {
+		return fmt.Errorf("error decoding '%s': %w", "value", err)
+	}
+	x.Value = uint64(v1)
+
+	return nil
+}
+
+// EncodeEzpack is used by ezpack.Encode in place of reflection
+func (x Drawing) EncodeEzpack(es genhelp.EncodeState) (*ezpack.PackMap, error) {
+	var pv ezpack.PackValue
+	var err error
+	elements := make([]ezpack.PackMapElement, 2)
+
+	// Extra
+	elements[0].Key = ezpack.PackString{String: "extra"}
+	pv, err = genhelp.EncodeField(es, &x.Extra, `ezpack:"extra,union"`)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding '%s': %w", "extra", err)
+	}
+	elements[0].Value = pv
+
+	// Main
+	elements[1].Key = ezpack.PackString{String: "main"}
+	pv, err = genhelp.EncodeField(es, &x.Main, `ezpack:"main,union"`)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding '%s': %w", "main", err)
+	}
+	elements[1].Value = pv
+
+	return &ezpack.PackMap{Elements: elements}, nil
+}
+
+// DecodeEzpack is used by ezpack.Decode in place of reflection
+func (x *Drawing) DecodeEzpack(ds genhelp.DecodeState, r io.Reader) error {
+	err := genhelp.ReadStructHeader(r, "Drawing", 2)
+	if err != nil {
+		return err
+	}
+
+	// Extra
+	err = genhelp.ReadFieldName(r, "extra")
+	if err != nil {
+		return err
+	}
+	err = genhelp.DecodeField(ds, r, &x.Extra, `ezpack:"extra,union"`)
+	if err != nil {
+		return fmt.Errorf("error decoding '%s': %w", "extra", err)
+	}
+
+	// Main
+	err = genhelp.ReadFieldName(r, "main")
+	if err != nil {
+		return err
+	}
+	err = genhelp.DecodeField(ds, r, &x.Main, `ezpack:"main,union"`)
+	if err != nil {
+		return fmt.Errorf("error decoding '%s': %w", "main", err)
+	}
+
+	return nil
+}
+
+// EncodeEzpack is used by ezpack.Encode in place of reflection
+func (x Money) EncodeEzpack(es genhelp.EncodeState) (*ezpack.PackMap, error) {
+	elements := make([]ezpack.PackMapElement, 1)
+
+	// Cents
+	elements[0].Key = ezpack.PackString{String: "cents"}
+	elements[0].Value = ezpack.PackUint64{Value: uint64(x.Cents)}
+
+	return &ezpack.PackMap{Elements: elements}, nil
+}
+
+// DecodeEzpack is used by ezpack.Decode in place of reflection
+func (x *Money) DecodeEzpack(ds genhelp.DecodeState, r io.Reader) error {
+	err := genhelp.ReadStructHeader(r, "Money", 1)
+	if err != nil {
+		return err
+	}
+
+	// Cents
+	err = genhelp.ReadFieldName(r, "cents")
+	if err != nil {
+		return err
+	}
+	v0, err := genhelp.ReadUint(r, reflect.Uint64)
+	if err != nil {
+		return fmt.Errorf("error decoding '%s': %w", "cents", err)
+	}
+	x.Cents = uint64(v0)
+
+	return nil
+}
+
+// EncodeEzpack is used by ezpack.Encode in place of reflection
+func (x Order) EncodeEzpack(es genhelp.EncodeState) (*ezpack.PackMap, error) {
+	var pv ezpack.PackValue
+	var err error
+	elements := make([]ezpack.PackMapElement, 2)
+
+	// Price
+	elements[0].Key = ezpack.PackString{String: "price"}
+	pv, err = genhelp.EncodeField(es, &x.Price, `ezpack:"price"`)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding '%s': %w", "price", err)
+	}
+	elements[0].Value = pv
+
+	// Quantity
+	elements[1].Key = ezpack.PackString{String: "quantity"}
+	elements[1].Value = ezpack.PackUint64{Value: uint64(x.Quantity)}
+
+	return &ezpack.PackMap{Elements: elements}, nil
+}
+
+// DecodeEzpack is used by ezpack.Decode in place of reflection
+func (x *Order) DecodeEzpack(ds genhelp.DecodeState, r io.Reader) error {
+	err := genhelp.ReadStructHeader(r, "Order", 2)
+	if err != nil {
+		return err
+	}
+
+	// Price
+	err = genhelp.ReadFieldName(r, "price")
+	if err != nil {
+		return err
+	}
+	err = genhelp.DecodeField(ds, r, &x.Price, `ezpack:"price"`)
+	if err != nil {
+		return fmt.Errorf("error decoding '%s': %w", "price", err)
+	}
+
+	// Quantity
+	err = genhelp.ReadFieldName(r, "quantity")
+	if err != nil {
+		return err
+	}
+	v1, err := genhelp.ReadUint(r, reflect.Uint16)
+	if err != nil {
+		return fmt.Errorf("error decoding '%s': %w", "quantity", err)
+	}
+	x.Quantity = uint16(v1)
+
+	return nil
+}
@@ -0,0 +1,286 @@
+// Code generated by ezpackgen. DO NOT EDIT.
+
+package example
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	"github.com/justicz/ezpack"
+	"github.com/justicz/ezpack/genhelp"
+)
+
+// ezpackgenRandomPlayer returns a random value of type t, or false if
+// testing/quick can't generate one (e.g. because t has unexported fields)
+func ezpackgenRandomPlayer(t reflect.Type, rng *rand.Rand) (v reflect.Value, ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+
+	return quick.Value(t, rng)
+}
+
+// ezpackgenCheckPlayer fails the test unless the generated code and the
+// reflection-based codec agreed
+func ezpackgenCheckPlayer(t *testing.T, what string, gen []byte, genErr error, ref []byte, refErr error) {
+	t.Helper()
+
+	if (genErr == nil) != (refErr == nil) || (genErr != nil && genErr.Error() != refErr.Error()) {
+		t.Fatalf("%s: generated code returned error %v, reflection returned %v", what, genErr, refErr)
+	}
+
+	if !bytes.Equal(gen, ref) {
+		t.Fatalf("%s: generated code produced %x, reflection produced %x", what, gen, ref)
+	}
+}
+
+func TestEzpackgenPlayer(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		rv, ok := ezpackgenRandomPlayer(reflect.TypeOf(Player{}), rng)
+		if !ok {
+			t.Skip("cannot generate random Player values")
+		}
+		x := rv.Interface().(Player)
+
+		// Encoding must produce the same bytes or error. With generated code
+		// disabled, nested types with generated code use reflection too
+		gen, genErr := ezpack.Encode(x)
+		var ref []byte
+		var refErr error
+		genhelp.WithReflection(func() {
+			ref, refErr = ezpack.Encode(x)
+		})
+		ezpackgenCheckPlayer(t, "Encode", gen, genErr, ref, refErr)
+		if genErr != nil {
+			continue
+		}
+
+		// Decoding must succeed or fail the same way
+		var genDec, refDec Player
+		genErr = ezpack.DecodeBytes(gen, &genDec)
+		genhelp.WithReflection(func() {
+			refErr = ezpack.DecodeBytes(gen, &refDec)
+		})
+		ezpackgenCheckPlayer(t, "Decode", nil, genErr, nil, refErr)
+		if genErr != nil {
+			continue
+		}
+
+		// And produce the same values, which we compare by encoding them again
+		// since random floats may be NaN
+		gen, genErr = ezpack.Encode(genDec)
+		ref, refErr = ezpack.Encode(refDec)
+		ezpackgenCheckPlayer(t, "Encode after Decode", gen, genErr, ref, refErr)
+	}
+}
+
+func TestEzpackgenPosition(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		rv, ok := ezpackgenRandomPlayer(reflect.TypeOf(Position{}), rng)
+		if !ok {
+			t.Skip("cannot generate random Position values")
+		}
+		x := rv.Interface().(Position)
+
+		// Encoding must produce the same bytes or error. With generated code
+		// disabled, nested types with generated code use reflection too
+		gen, genErr := ezpack.Encode(x)
+		var ref []byte
+		var refErr error
+		genhelp.WithReflection(func() {
+			ref, refErr = ezpack.Encode(x)
+		})
+		ezpackgenCheckPlayer(t, "Encode", gen, genErr, ref, refErr)
+		if genErr != nil {
+			continue
+		}
+
+		// Decoding must succeed or fail the same way
+		var genDec, refDec Position
+		genErr = ezpack.DecodeBytes(gen, &genDec)
+		genhelp.WithReflection(func() {
+			refErr = ezpack.DecodeBytes(gen, &refDec)
+		})
+		ezpackgenCheckPlayer(t, "Decode", nil, genErr, nil, refErr)
+		if genErr != nil {
+			continue
+		}
+
+		// And produce the same values, which we compare by encoding them again
+		// since random floats may be NaN
+		gen, genErr = ezpack.Encode(genDec)
+		ref, refErr = ezpack.Encode(refDec)
+		ezpackgenCheckPlayer(t, "Encode after Decode", gen, genErr, ref, refErr)
+	}
+}
+
+func TestEzpackgenNode(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		rv, ok := ezpackgenRandomPlayer(reflect.TypeOf(Node{}), rng)
+		if !ok {
+			t.Skip("cannot generate random Node values")
+		}
+		x := rv.Interface().(Node)
+
+		// Encoding must produce the same bytes or error. With generated code
+		// disabled, nested types with generated code use reflection too
+		gen, genErr := ezpack.Encode(x)
+		var ref []byte
+		var refErr error
+		genhelp.WithReflection(func() {
+			ref, refErr = ezpack.Encode(x)
+		})
+		ezpackgenCheckPlayer(t, "Encode", gen, genErr, ref, refErr)
+		if genErr != nil {
+			continue
+		}
+
+		// Decoding must succeed or fail the same way
+		var genDec, refDec Node
+		genErr = ezpack.DecodeBytes(gen, &genDec)
+		genhelp.WithReflection(func() {
+			refErr = ezpack.DecodeBytes(gen, &refDec)
+		})
+		ezpackgenCheckPlayer(t, "Decode", nil, genErr, nil, refErr)
+		if genErr != nil {
+			continue
+		}
+
+		// And produce the same values, which we compare by encoding them again
+		// since random floats may be NaN
+		gen, genErr = ezpack.Encode(genDec)
+		ref, refErr = ezpack.Encode(refDec)
+		ezpackgenCheckPlayer(t, "Encode after Decode", gen, genErr, ref, refErr)
+	}
+}
+
+func TestEzpackgenDrawing(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		rv, ok := ezpackgenRandomPlayer(reflect.TypeOf(Drawing{}), rng)
+		if !ok {
+			t.Skip("cannot generate random Drawing values")
+		}
+		x := rv.Interface().(Drawing)
+
+		// Encoding must produce the same bytes or error. With generated code
+		// disabled, nested types with generated code use reflection too
+		gen, genErr := ezpack.Encode(x)
+		var ref []byte
+		var refErr error
+		genhelp.WithReflection(func() {
+			ref, refErr = ezpack.Encode(x)
+		})
+		ezpackgenCheckPlayer(t, "Encode", gen, genErr, ref, refErr)
+		if genErr != nil {
+			continue
+		}
+
+		// Decoding must succeed or fail the same way
+		var genDec, refDec Drawing
+		genErr = ezpack.DecodeBytes(gen, &genDec)
+		genhelp.WithReflection(func() {
+			refErr = ezpack.DecodeBytes(gen, &refDec)
+		})
+		ezpackgenCheckPlayer(t, "Decode", nil, genErr, nil, refErr)
+		if genErr != nil {
+			continue
+		}
+
+		// And produce the same values, which we compare by encoding them again
+		// since random floats may be NaN
+		gen, genErr = ezpack.Encode(genDec)
+		ref, refErr = ezpack.Encode(refDec)
+		ezpackgenCheckPlayer(t, "Encode after Decode", gen, genErr, ref, refErr)
+	}
+}
+
+func TestEzpackgenMoney(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		rv, ok := ezpackgenRandomPlayer(reflect.TypeOf(Money{}), rng)
+		if !ok {
+			t.Skip("cannot generate random Money values")
+		}
+		x := rv.Interface().(Money)
+
+		// Encoding must produce the same bytes or error. With generated code
+		// disabled, nested types with generated code use reflection too
+		gen, genErr := ezpack.Encode(x)
+		var ref []byte
+		var refErr error
+		genhelp.WithReflection(func() {
+			ref, refErr = ezpack.Encode(x)
+		})
+		ezpackgenCheckPlayer(t, "Encode", gen, genErr, ref, refErr)
+		if genErr != nil {
+			continue
+		}
+
+		// Decoding must succeed or fail the same way
+		var genDec, refDec Money
+		genErr = ezpack.DecodeBytes(gen, &genDec)
+		genhelp.WithReflection(func() {
+			refErr = ezpack.DecodeBytes(gen, &refDec)
+		})
+		ezpackgenCheckPlayer(t, "Decode", nil, genErr, nil, refErr)
+		if genErr != nil {
+			continue
+		}
+
+		// And produce the same values, which we compare by encoding them again
+		// since random floats may be NaN
+		gen, genErr = ezpack.Encode(genDec)
+		ref, refErr = ezpack.Encode(refDec)
+		ezpackgenCheckPlayer(t, "Encode after Decode", gen, genErr, ref, refErr)
+	}
+}
+
+func TestEzpackgenOrder(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		rv, ok := ezpackgenRandomPlayer(reflect.TypeOf(Order{}), rng)
+		if !ok {
+			t.Skip("cannot generate random Order values")
+		}
+		x := rv.Interface().(Order)
+
+		// Encoding must produce the same bytes or error. With generated code
+		// disabled, nested types with generated code use reflection too
+		gen, genErr := ezpack.Encode(x)
+		var ref []byte
+		var refErr error
+		genhelp.WithReflection(func() {
+			ref, refErr = ezpack.Encode(x)
+		})
+		ezpackgenCheckPlayer(t, "Encode", gen, genErr, ref, refErr)
+		if genErr != nil {
+			continue
+		}
+
+		// Decoding must succeed or fail the same way
+		var genDec, refDec Order
+		genErr = ezpack.DecodeBytes(gen, &genDec)
+		genhelp.WithReflection(func() {
+			refErr = ezpack.DecodeBytes(gen, &refDec)
+		})
+		ezpackgenCheckPlayer(t, "Decode", nil, genErr, nil, refErr)
+		if genErr != nil {
+			continue
+		}
+
+		// And produce the same values, which we compare by encoding them again
+		// since random floats may be NaN
+		gen, genErr = ezpack.Encode(genDec)
+		ref, refErr = ezpack.Encode(refDec)
+		ezpackgenCheckPlayer(t, "Encode after Decode", gen, genErr, ref, refErr)
+	}
+}
@@ -0,0 +1,166 @@
+// Command ezpackgen generates ezpack methods for struct types that encode and
+// decode their fields without reflection.
+//
+// Add a directive like this to a file in the package defining the types:
+//
+//	//go:generate go run github.com/justicz/ezpack/cmd/ezpackgen -type Point,Line
+//
+// For each type, ezpackgen writes an EncodeEzpack and a DecodeEzpack method.
+// ezpack.Encode and ezpack.Decode use them automatically in place of
+// reflection, and they produce the same bytes and errors. Generated code is not
+// much faster than reflection, since most of the work is in the wire format
+// itself. ezpackgen also writes a test checking the generated code against
+// reflection with random values.
+//
+// Fields of type bool, string, []byte, the integer types, and the other types
+// named with -type are encoded and decoded inline. Fields of any other type, or
+// with tag options other than a max length, are passed to genhelp.EncodeField
+// and genhelp.DecodeField, which use reflection. So are fields of types named
+// with -type that have a MarshalEzpack or UnmarshalEzpack method, or embedded
+// fields that could promote one, since reflection uses those methods in place
+// of the generated ones. Inline fields are not supported.
+//
+// Extension types are registered at run time, so ezpackgen can't see them.
+// Extensions registered for bool, string, []byte, the integer types, or the
+// types named with -type are ignored by the generated code.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	typeFlag = flag.String("type", "", "comma-separated list of struct type names; required")
+	output   = flag.String("output", "", "output file name; default <dir>/<type>_ezpack.go")
+	noTest   = flag.Bool("notest", false, "don't write a test file")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: ezpackgen -type T[,T...] [-output file] [-notest] [dir]\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if *typeFlag == "" || flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	dir := "."
+	if flag.NArg() == 1 {
+		dir = flag.Arg(0)
+	}
+
+	types := strings.Split(*typeFlag, ",")
+	outName := *output
+	if outName == "" {
+		outName = filepath.Join(dir, strings.ToLower(types[0])+"_ezpack.go")
+	}
+
+	err := run(dir, types, outName, !*noTest)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ezpackgen: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// run generates code for types in the package in dir, writing it to outName
+// and, if withTest is set, a test to the matching _test.go file
+func run(dir string, types []string, outName string, withTest bool) error {
+	pkg, err := parsePackage(dir, types)
+	if err != nil {
+		return err
+	}
+
+	src, err := generate(pkg, types)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(outName, src, 0644)
+	if err != nil {
+		return err
+	}
+
+	if !withTest {
+		return nil
+	}
+
+	testSrc, err := generateTest(pkg, types)
+	if err != nil {
+		return err
+	}
+
+	testName := strings.TrimSuffix(outName, ".go") + "_test.go"
+	return ioutil.WriteFile(testName, testSrc, 0644)
+}
+
+// parsePackage parses the non-test Go files in dir and returns the package
+// that defines types
+func parsePackage(dir string, types []string) (*ast.Package, error) {
+	fset := token.NewFileSet()
+	notTest := func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}
+
+	pkgs, err := parser.ParseDir(fset, dir, notTest, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pick the package that defines the first type. Use a stable order so that
+	// errors are reported the same way every time
+	var names []string
+	for name := range pkgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if findStruct(pkgs[name], types[0]) != nil {
+			return pkgs[name], nil
+		}
+	}
+
+	return nil, fmt.Errorf("no struct type %s in %s", types[0], dir)
+}
+
+// findStruct returns the definition of the struct type named name in pkg, or
+// nil if there isn't one
+func findStruct(pkg *ast.Package, name string) *ast.StructType {
+	var found *ast.StructType
+	for _, file := range pkg.Files {
+		for _, decl := range file.Decls {
+			gd, ok := decl.(*ast.GenDecl)
+			if !ok || gd.Tok != token.TYPE {
+				continue
+			}
+
+			for _, spec := range gd.Specs {
+				ts := spec.(*ast.TypeSpec)
+				if ts.Name.Name != name {
+					continue
+				}
+
+				st, ok := ts.Type.(*ast.StructType)
+				if ok {
+					found = st
+				}
+			}
+		}
+	}
+
+	return found
+}
@@ -1,13 +1,16 @@
 package ezpack
 
 import (
+	"encoding"
 	"fmt"
 	"math"
+	"math/big"
 	"reflect"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // maxTagFieldNameLength is the maximum allowed length of a field name
@@ -16,13 +19,103 @@ const maxTagFieldNameLength = 32
 
 // ezPackStructTag contains the parsed out values from a struct tag
 type ezPackStructTag struct {
-	FieldName string
-	MaxLen    uint32
+	FieldName   string
+	MaxLen      uint32
+	ElemMaxLen  uint32
+	KeyMaxLen   uint32
+	StrictFloat bool
+	NormFloat   bool
+	Inline      bool
+	Binary      bool
+	Text        bool
+	Union       bool
 }
 
-// tagRegex matches what we're looking for in a struct tag
-// (currently just the encoded field name)
-var tagRegex = regexp.MustCompile(`ezpack:"(\w+)(,(\d+))?".*`)
+// Limits holds the limits and options that would otherwise come from a struct
+// tag, for values encoded or decoded at the top level with EncodeValue and
+// DecodeValue. The lengths only matter when decoding
+type Limits struct {
+	MaxLen     uint32
+	ElemMaxLen uint32
+	KeyMaxLen  uint32
+
+	// These are the same as the struct tag options of the same names
+	StrictFloat bool
+	NormFloat   bool
+	Binary      bool
+	Text        bool
+	Union       bool
+}
+
+// tag returns the struct tag parameters equivalent to l, checking that the
+// options don't conflict like parseStructTag does
+func (l Limits) tag() (ezPackStructTag, error) {
+	if l.StrictFloat && l.NormFloat {
+		return ezPackStructTag{}, fmt.Errorf("cannot use both StrictFloat and NormFloat")
+	}
+	if l.Binary && l.Text {
+		return ezPackStructTag{}, fmt.Errorf("cannot use both Binary and Text")
+	}
+
+	return ezPackStructTag{
+		MaxLen:      l.MaxLen,
+		ElemMaxLen:  l.ElemMaxLen,
+		KeyMaxLen:   l.KeyMaxLen,
+		StrictFloat: l.StrictFloat,
+		NormFloat:   l.NormFloat,
+		Binary:      l.Binary,
+		Text:        l.Text,
+		Union:       l.Union,
+	}, nil
+}
+
+// elemTag returns the struct tag parameters that apply to the elements of a
+// container field (e.g. the values of a map or the elements of a slice). The
+// key length carries through, so that it applies to maps held in slices,
+// arrays or pointers
+func (ezst ezPackStructTag) elemTag() ezPackStructTag {
+	return ezPackStructTag{
+		FieldName:   ezst.FieldName,
+		MaxLen:      ezst.ElemMaxLen,
+		KeyMaxLen:   ezst.KeyMaxLen,
+		StrictFloat: ezst.StrictFloat,
+		NormFloat:   ezst.NormFloat,
+		Binary:      ezst.Binary,
+		Text:        ezst.Text,
+		Union:       ezst.Union,
+	}
+}
+
+// tagRegex matches what we're looking for in a struct tag: the encoded field
+// name (which may only be omitted for inline fields), an optional max length,
+// and any number of comma separated options, which may take a numeric argument
+// (e.g. keylen=32)
+var tagRegex = regexp.MustCompile(`ezpack:"(\w*)(,(\d+))?((,\w+(=\d+)?)*)".*`)
+
+// parseTagLength parses a length specified in a struct tag, ensuring it won't
+// cause problems for 32-bit system ints
+func parseTagLength(s string, what string, fieldName string) (uint32, error) {
+	length, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing %s for '%s': %s", what, fieldName, err)
+	}
+
+	if length > math.MaxInt32 {
+		return 0, fmt.Errorf("%s for '%s' too long: max is %d", what, fieldName, math.MaxInt32)
+	}
+
+	return uint32(length), nil
+}
+
+// parseTagFlag checks that an option which acts as a flag was not given an
+// argument, and returns true if so
+func parseTagFlag(opt string, optArg string, fieldName string) (bool, error) {
+	if optArg != "" {
+		return false, fmt.Errorf("option '%s' does not take a length on '%s'", opt, fieldName)
+	}
+
+	return true, nil
+}
 
 // parseStructTag parses the struct tag on a particular field into
 // an ezPackStructTag containing the tag's specified parameters
@@ -31,7 +124,7 @@ func parseStructTag(st reflect.StructTag, goFieldName string) (ezst ezPackStruct
 	m := tagRegex.FindSubmatch([]byte(st))
 
 	// Ensure we match the ezpack struct tag regex
-	if len(m) != 4 {
+	if len(m) != 7 {
 		err = fmt.Errorf("valid ezpack struct tag required on '%s'", goFieldName)
 		return
 	}
@@ -40,94 +133,310 @@ func parseStructTag(st reflect.StructTag, goFieldName string) (ezst ezPackStruct
 	encFieldName := string(m[1])
 	if len(encFieldName) > maxTagFieldNameLength {
 		err = fmt.Errorf("field name too long on '%s', max %d", goFieldName, maxTagFieldNameLength)
+		return
 	}
 
 	// Fill in parsed name
 	ezst.FieldName = encFieldName
 
 	// Fill in parsed max length, default to 0
-	var maxLength uint64
 	if len(m[3]) != 0 {
-		maxLength, err = strconv.ParseUint(string(m[3]), 10, 32)
+		ezst.MaxLen, err = parseTagLength(string(m[3]), "max len", ezst.FieldName)
 		if err != nil {
-			err = fmt.Errorf("error parsing max len for '%s': %s", ezst.FieldName, err)
 			return
 		}
 	}
 
-	// Check max len won't cause problems for 32-bit system ints and copy in
-	if maxLength > math.MaxInt32 {
-		err = fmt.Errorf("max len for '%s' too long: max is %d", ezst.FieldName, math.MaxInt32)
+	// Fill in any options
+	if len(m[4]) != 0 {
+		for _, opt := range strings.Split(string(m[4][1:]), ",") {
+			// Split off the option's argument, if any
+			optArg := ""
+			if i := strings.IndexByte(opt, '='); i >= 0 {
+				opt, optArg = opt[:i], opt[i+1:]
+			}
+
+			// Fill in the option
+			switch opt {
+			case "keylen":
+				ezst.KeyMaxLen, err = parseTagLength(optArg, "key len", ezst.FieldName)
+			case "elemlen":
+				ezst.ElemMaxLen, err = parseTagLength(optArg, "elem len", ezst.FieldName)
+			case "strictfloat":
+				ezst.StrictFloat, err = parseTagFlag(opt, optArg, ezst.FieldName)
+			case "normfloat":
+				ezst.NormFloat, err = parseTagFlag(opt, optArg, ezst.FieldName)
+			case "inline":
+				ezst.Inline, err = parseTagFlag(opt, optArg, ezst.FieldName)
+			case "binary":
+				ezst.Binary, err = parseTagFlag(opt, optArg, ezst.FieldName)
+			case "text":
+				ezst.Text, err = parseTagFlag(opt, optArg, ezst.FieldName)
+			case "union":
+				ezst.Union, err = parseTagFlag(opt, optArg, ezst.FieldName)
+			default:
+				err = fmt.Errorf("unknown option '%s' in struct tag on '%s'", opt, goFieldName)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	// Check that options don't conflict
+	if ezst.StrictFloat && ezst.NormFloat {
+		err = fmt.Errorf("cannot use both strictfloat and normfloat on '%s'", goFieldName)
+		return
+	}
+	if ezst.Binary && ezst.Text {
+		err = fmt.Errorf("cannot use both binary and text on '%s'", goFieldName)
+		return
+	}
+
+	// Inline fields are flattened into their parent, so they don't have a
+	// name or any parameters of their own. Every other field needs a name
+	if ezst.Inline {
+		if ezst != (ezPackStructTag{Inline: true}) {
+			err = fmt.Errorf("inline field '%s' cannot have a name, length or other options", goFieldName)
+		}
+		return
+	}
+	if ezst.FieldName == "" {
+		err = fmt.Errorf("valid ezpack struct tag required on '%s'", goFieldName)
 		return
 	}
-	ezst.MaxLen = uint32(maxLength)
 
 	return
 }
 
-// parsedStructField stores a parsed struct tag and its struct offset in a
-// convenient struct for sorting
+// canonicalFloat applies the float policy selected in a struct tag to f. With
+// strictfloat, NaN, ±Inf and -0 are rejected. With normfloat, -0 is folded to
+// +0. NaN payloads are always made canonical by PackFloat32/PackFloat64.
+func canonicalFloat(f float64, ezst ezPackStructTag) (float64, error) {
+	if ezst.StrictFloat {
+		if math.IsNaN(f) || math.IsInf(f, 0) || (f == 0 && math.Signbit(f)) {
+			return 0, fmt.Errorf("%v not allowed with strictfloat", f)
+		}
+	}
+
+	if ezst.NormFloat && f == 0 {
+		return 0, nil
+	}
+
+	return f, nil
+}
+
+// Struct types that have their own encoding rather than being encoded as a map
+var (
+	timeType   = reflect.TypeOf(time.Time{})
+	bigIntType = reflect.TypeOf(big.Int{})
+)
+
+// Interface types that change how a value is encoded or decoded
+var (
+	marshalerType         = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	unmarshalerType       = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	binaryMarshalerType   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+	textMarshalerType     = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType   = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// topLevelValue returns the value of o as passed to one of our entry points,
+// dereferencing it once if it is a pointer
+func topLevelValue(o interface{}) reflect.Value {
+	v := reflect.ValueOf(o)
+	if v.Kind() == reflect.Ptr {
+		// Elem returns the value that the pointer points to
+		v = v.Elem()
+	}
+
+	return v
+}
+
+// checkPointerType returns an error if the pointer type t points to something
+// that can itself be nil. That would be encoded the same way as a nil pointer,
+// so it couldn't round trip
+func checkPointerType(t reflect.Type) error {
+	switch t.Elem().Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return fmt.Errorf("cannot use %s: pointers to pointers or interfaces are not supported", t)
+	}
+
+	return nil
+}
+
+// methodReceiver returns v, or a pointer to v if the interface needs pointer
+// receiver methods, as an interface{} implementing iface. If v isn't
+// addressable, the pointer is to a copy of v. Pointers are never returned, so
+// that nil is still handled for them
+func methodReceiver(v reflect.Value, iface reflect.Type) (interface{}, bool) {
+	if v.Kind() == reflect.Ptr || !v.CanInterface() {
+		return nil, false
+	}
+
+	// Value receiver methods are enough
+	if v.Type().Implements(iface) {
+		return v.Interface(), true
+	}
+
+	// Otherwise we need pointer receiver methods
+	if !reflect.PtrTo(v.Type()).Implements(iface) {
+		return nil, false
+	}
+	if v.CanAddr() {
+		return v.Addr().Interface(), true
+	}
+	ptr := reflect.New(v.Type())
+	ptr.Elem().Set(v)
+	return ptr.Interface(), true
+}
+
+// checkCanonicalFloat ensures f is allowed by the float policy selected in a
+// struct tag, and that the policy would not have changed it (e.g. -0 with
+// normfloat)
+func checkCanonicalFloat(f float64, ezst ezPackStructTag) error {
+	canon, err := canonicalFloat(f, ezst)
+	if err != nil {
+		return err
+	}
+
+	if !math.IsNaN(f) && math.Float64bits(canon) != math.Float64bits(f) {
+		return fmt.Errorf("got non-canonical float %v", f)
+	}
+
+	return nil
+}
+
+// checkKeyOrder ensures that key sorts strictly after lastKey. Map keys must be
+// strictly increasing so that each map has exactly one encoding (this also
+// rules out duplicates)
+func checkKeyOrder(lastKey, key string) error {
+	r := strings.Compare(lastKey, key)
+	if r == 0 {
+		return fmt.Errorf("found duplicate key '%s'", key)
+	}
+	if r > 0 {
+		return fmt.Errorf("map keys not sorted: '%s' after '%s'", key, lastKey)
+	}
+
+	return nil
+}
+
+// parsedStructField stores a parsed struct tag and its struct field index in a
+// convenient struct for sorting. The index is a path (as used by
+// reflect.Value.FieldByIndex) so that fields of inline structs can be reached
 type parsedStructField struct {
-	offset          int
+	index           []int
 	parsedStructTag ezPackStructTag
 }
 
 // sortStructFields returns a sorted slice of parsedStructFields, containing
-// the field offset and expected name on the wire for each field. t.Kind()
+// the field index and expected name on the wire for each field. Fields of
+// embedded structs tagged inline are flattened into the result. t.Kind()
 // must be reflect.Struct
 func sortStructFields(t reflect.Type) ([]parsedStructField, error) {
+	// Build slice of parsed struct fields for sorting
+	var parsedFields []parsedStructField
+	err := collectStructFields(t, nil, &parsedFields)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sort struct fields by name on the wire
+	sort.Slice(parsedFields, func(i, j int) bool {
+		iName := parsedFields[i].parsedStructTag.FieldName
+		jName := parsedFields[j].parsedStructTag.FieldName
+		r := strings.Compare(iName, jName)
+		return r == -1
+	})
+
+	// Do a scan to check for duplicate names (which are now sorted). This
+	// covers the fields of inline structs too
+	for i := range parsedFields {
+		if i == 0 {
+			// Skip first element (still correct if only one)
+			continue
+		}
+		// Compare this element with the last and ensure they are not equal
+		fname := parsedFields[i].parsedStructTag.FieldName
+		lname := parsedFields[i-1].parsedStructTag.FieldName
+		if fname == lname {
+			return nil, fmt.Errorf("found duplicate key '%s'", fname)
+		}
+	}
+
+	// Ensure we are not dealing with a massive struct
+	if len(parsedFields) > math.MaxInt32 {
+		return nil, fmt.Errorf("cannot decode massive struct")
+	}
+
+	return parsedFields, nil
+}
+
+// collectStructFields appends a parsedStructField for each field of t to out,
+// recursing into embedded structs tagged inline and skipping fields tagged
+// with "-". index is the path from the top-level struct to t
+func collectStructFields(t reflect.Type, index []int, out *[]parsedStructField) error {
 	// Ensure we were passed a struct
 	if t.Kind() != reflect.Struct {
-		return nil, fmt.Errorf("can only sort struct fields, not %s", t.Kind())
+		return fmt.Errorf("can only sort struct fields, not %s", t.Kind())
 	}
 
 	// Ensure we are not dealing with a massive struct
 	numFields := t.NumField()
 	if numFields < 0 || numFields > math.MaxInt32 {
-		return nil, fmt.Errorf("cannot decode massive struct")
+		return fmt.Errorf("cannot decode massive struct")
 	}
 
-	// Build slice of parsed struct fields for sorting
-	parsedFields := make([]parsedStructField, 0, numFields)
 	for i := 0; i < numFields; i++ {
 		// Fetch the field
 		field := t.Field(i)
 
+		// Skip fields tagged with "-", they are not part of the map at all
+		if field.Tag.Get("ezpack") == "-" {
+			continue
+		}
+
 		// Parse the struct tag
 		pstag, err := parseStructTag(field.Tag, field.Name)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		// Fill in and append information about this field we'll use for sorting
-		psfield := parsedStructField{
-			offset:          i,
-			parsedStructTag: pstag,
+		// We can't set unexported fields, so refuse to handle them at all rather
+		// than failing part way through. Unexported embedded structs may still be
+		// inline, because their exported fields are promoted
+		if field.PkgPath != "" && !pstag.Inline {
+			return fmt.Errorf("unexported field '%s' must be exported or tagged with ezpack:\"-\"", field.Name)
 		}
-		parsedFields = append(parsedFields, psfield)
-	}
 
-	// Sort struct fields by name on the wire
-	sort.Slice(parsedFields, func(i, j int) bool {
-		iName := parsedFields[i].parsedStructTag.FieldName
-		jName := parsedFields[j].parsedStructTag.FieldName
-		r := strings.Compare(iName, jName)
-		return r == -1
-	})
+		// Build the path to this field. Copy so that sibling fields don't share
+		// a backing array
+		fieldIndex := make([]int, len(index)+1)
+		copy(fieldIndex, index)
+		fieldIndex[len(index)] = i
 
-	// Do a scan to check for duplicate names (which are now sorted)
-	for i := range parsedFields {
-		if i == 0 {
-			// Skip first element (still correct if only one)
+		// Flatten inline fields into the parent
+		if pstag.Inline {
+			if !field.Anonymous || field.Type.Kind() != reflect.Struct {
+				return fmt.Errorf("inline requires an embedded struct on '%s'", field.Name)
+			}
+
+			err = collectStructFields(field.Type, fieldIndex, out)
+			if err != nil {
+				return err
+			}
 			continue
 		}
-		// Compare this element with the last and ensure they are not equal
-		fname := parsedFields[i].parsedStructTag.FieldName
-		lname := parsedFields[i-1].parsedStructTag.FieldName
-		if fname == lname {
-			return nil, fmt.Errorf("found duplicate key '%s'", fname)
+
+		// Fill in and append information about this field we'll use for sorting
+		psfield := parsedStructField{
+			index:           fieldIndex,
+			parsedStructTag: pstag,
 		}
+		*out = append(*out, psfield)
 	}
 
-	return parsedFields, nil
+	return nil
 }
@@ -0,0 +1,132 @@
+package ezpack
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrTruncated is returned by Decoder when the stream ends part way through a
+// message
+var ErrTruncated = errors.New("message truncated")
+
+// ErrMessageTooLong is returned by Decoder when a message is longer than
+// DecoderOptions.MaxMessageLen
+var ErrMessageTooLong = errors.New("message too long")
+
+// DecoderOptions configures a Decoder
+type DecoderOptions struct {
+	// MaxMessageLen is the maximum number of bytes in a single message, or 0
+	// for no limit beyond those in the struct tags
+	MaxMessageLen int64
+}
+
+// Decoder reads a sequence of encoded structs from an io.Reader. It never
+// reads past the end of the message being decoded, so it does no buffering of
+// its own: wrap the reader in a bufio.Reader if reads are expensive
+type Decoder struct {
+	cr  countingReader
+	err error
+}
+
+// NewDecoder returns a Decoder reading from r
+func NewDecoder(r io.Reader, opts DecoderOptions) *Decoder {
+	return &Decoder{
+		cr: countingReader{
+			r:     r,
+			limit: opts.MaxMessageLen,
+		},
+	}
+}
+
+// Decode decodes the next message from the stream into o, which must be a
+// pointer to a struct. It returns io.EOF if the stream ended cleanly between
+// messages, and ErrTruncated if it ended part way through one. Any other
+// error from the underlying reader is returned as is. After an error part way
+// through a message, or from the underlying reader, the position in the
+// stream is unknown, so every later call returns the same error. Errors found
+// before any of the message was read (e.g. a bad struct tag) are not sticky
+func (d *Decoder) Decode(o interface{}) (err error) {
+	if d.err != nil {
+		return d.err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("recovered panic in Decoder.Decode: %s", r)
+		}
+
+		// Only give up on the stream if we no longer know where we are in it
+		if err != nil && (d.cr.msgN > 0 || d.cr.readErr != nil) {
+			d.err = err
+		}
+	}()
+
+	// Take the value of the interface{} object, dereferencing once if passed
+	// a pointer
+	v := topLevelValue(o)
+
+	// Start counting a new message
+	d.cr.startMessage()
+
+	err = decodeStruct(&d.cr, v, newDecodeState())
+	if err == nil || !errors.Is(err, ErrBufTooShort) {
+		return err
+	}
+
+	// We couldn't read enough, so work out why
+	switch {
+	case d.cr.readErr == io.EOF && d.cr.msgN == 0:
+		return io.EOF
+	case d.cr.readErr == io.EOF || d.cr.readErr == io.ErrUnexpectedEOF:
+		return ErrTruncated
+	case d.cr.readErr != nil:
+		return d.cr.readErr
+	default:
+		return err
+	}
+}
+
+// InputOffset returns the total number of bytes consumed from the underlying
+// reader
+func (d *Decoder) InputOffset() int64 {
+	return d.cr.n
+}
+
+// countingReader counts the bytes read from r, both in total and for the
+// current message, and records the last error r returned
+type countingReader struct {
+	r       io.Reader
+	n       int64
+	msgN    int64
+	limit   int64
+	readErr error
+}
+
+// startMessage resets the per-message count
+func (cr *countingReader) startMessage() {
+	cr.msgN = 0
+	cr.readErr = nil
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	// Enforce the per-message limit, never reading past it
+	if cr.limit > 0 {
+		remaining := cr.limit - cr.msgN
+		if remaining <= 0 {
+			cr.readErr = ErrMessageTooLong
+			return 0, cr.readErr
+		}
+		if int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+	}
+
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	cr.msgN += int64(n)
+	if err != nil {
+		cr.readErr = err
+	}
+
+	return n, err
+}
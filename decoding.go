@@ -2,15 +2,24 @@ package ezpack
 
 import (
 	"bytes"
+	"encoding"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"math"
+	"math/big"
 	"reflect"
+	"time"
 )
 
 var ErrBufTooShort = errors.New("buffer too short")
+var ErrTrailingBytes = errors.New("trailing bytes after decoded value")
+var ErrMaxDepth = errors.New("max nesting depth exceeded during decoding")
+
+// maxDecodeDepth bounds how deeply values may be nested on the wire, so that
+// malicious inputs can't exhaust the stack through recursive types
+const maxDecodeDepth = 1000
 
 func Decode(data io.Reader, o interface{}) (err error) {
 	defer func() {
@@ -19,12 +28,83 @@ func Decode(data io.Reader, o interface{}) (err error) {
 		}
 	}()
 
-	return decodeStruct(data, o)
+	// Take the value of the interface{} object, dereferencing once if passed
+	// a pointer
+	v := topLevelValue(o)
+
+	return decodeStruct(data, v, newDecodeState())
 }
 
+// DecodeBytes decodes data into o, which must be a pointer to a struct. data
+// must hold exactly one encoded struct, so any trailing bytes are an error
 func DecodeBytes(data []byte, o interface{}) (err error) {
-	buf := bytes.NewBuffer(data)
-	return Decode(buf, o)
+	n, err := DecodeBytesPrefix(data, o)
+	if err != nil {
+		return err
+	}
+
+	// Ensure nothing is left over, otherwise many different inputs would decode
+	// to the same value
+	if n != len(data) {
+		return ErrTrailingBytes
+	}
+
+	return nil
+}
+
+// DecodeBytesPrefix decodes a struct from the start of data into o, which must
+// be a pointer to a struct, and returns the number of bytes consumed. Any bytes
+// after the struct are left alone, for callers that concatenate messages
+func DecodeBytesPrefix(data []byte, o interface{}) (n int, err error) {
+	buf := bytes.NewReader(data)
+	err = Decode(buf, o)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data) - buf.Len(), nil
+}
+
+// DecodeValue is like Decode, but accepts any supported value at the top level
+// rather than only structs. o must be a pointer to the value to decode into.
+// There is no struct tag at the top level, so limits gives the limits to
+// enforce and the options to apply instead
+func DecodeValue(data io.Reader, o interface{}, limits Limits) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("recovered panic in DecodeValue: %s", r)
+		}
+	}()
+
+	// We need a pointer so that we can set the value
+	v := reflect.ValueOf(o)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("DecodeValue requires non-nil pointer, not %s", v.Kind())
+	}
+
+	ezst, err := limits.tag()
+	if err != nil {
+		return err
+	}
+
+	return decodeValue(data, v.Elem(), ezst, newDecodeState())
+}
+
+// DecodeValueBytes is like DecodeBytes, but accepts any supported value at the
+// top level. Any trailing bytes are an error
+func DecodeValueBytes(data []byte, o interface{}, limits Limits) (err error) {
+	buf := bytes.NewReader(data)
+	err = DecodeValue(buf, o, limits)
+	if err != nil {
+		return err
+	}
+
+	// Ensure nothing is left over
+	if buf.Len() != 0 {
+		return ErrTrailingBytes
+	}
+
+	return nil
 }
 
 func decodeCommonHeader(data io.Reader, expectedType byte) (length uint32, err error) {
@@ -88,6 +168,100 @@ func decodeByteSlice(data io.Reader, maxLength uint32) ([]byte, error) {
 	return out, nil
 }
 
+func decodeByteArray(data io.Reader, out []byte) error {
+	// Decode the header
+	length, err := decodeCommonHeader(data, PackBytesID)
+	if err != nil {
+		return err
+	}
+
+	// Length should be exact for arrays
+	if length != uint32(len(out)) {
+		return fmt.Errorf("expected array of length %d, got %d", len(out), length)
+	}
+
+	// Read the bytes directly into the array
+	_, err = io.ReadFull(data, out)
+	if err != nil {
+		return ErrBufTooShort
+	}
+
+	return nil
+}
+
+func decodePackExt(data io.Reader, maxLength uint32) (PackExt, error) {
+	// Decode the header
+	length, err := decodeCommonHeader(data, PackExt32ID)
+	if err != nil {
+		return PackExt{}, err
+	}
+
+	// Enforce maximum length
+	err = checkMaxLength(length, maxLength)
+	if err != nil {
+		return PackExt{}, err
+	}
+
+	// Read the extension type and the requested number of bytes
+	out := make([]byte, length+1)
+	_, err = io.ReadFull(data, out)
+	if err != nil {
+		return PackExt{}, ErrBufTooShort
+	}
+
+	return PackExt{
+		Type: int8(out[0]),
+		Data: out[1:],
+	}, nil
+}
+
+func decodeBigInt(data io.Reader, maxLength uint32) (*big.Int, error) {
+	// Decode the header
+	length, err := decodeCommonHeader(data, PackBytesID)
+	if err != nil {
+		return nil, err
+	}
+
+	// We need at least the sign byte
+	if length == 0 {
+		return nil, fmt.Errorf("got big integer with no sign byte")
+	}
+
+	// Enforce maximum length of the magnitude
+	err = checkMaxLength(length-1, maxLength)
+	if err != nil {
+		return nil, err
+	}
+
+	// Allocate space for the bytes and read them
+	out := make([]byte, length)
+	_, err = io.ReadFull(data, out)
+	if err != nil {
+		return nil, ErrBufTooShort
+	}
+
+	// Ensure the encoding is minimal, so that each integer has exactly one
+	// encoding
+	sign, mag := out[0], out[1:]
+	if sign != BigIntNonNegative && sign != BigIntNegative {
+		return nil, fmt.Errorf("got invalid big integer sign byte %x", sign)
+	}
+	if len(mag) > 0 && mag[0] == 0 {
+		return nil, fmt.Errorf("got non-canonical big integer with leading zero bytes")
+	}
+	if len(mag) == 0 && sign == BigIntNegative {
+		return nil, fmt.Errorf("got non-canonical big integer negative zero")
+	}
+
+	// Build the integer
+	b := new(big.Int).SetBytes(mag)
+	if sign == BigIntNegative {
+		b.Neg(b)
+	}
+
+	return b, nil
+}
+
 func decodeString(data io.Reader, maxLength uint32) (string, error) {
 	// Decode the header
 	length, err := decodeCommonHeader(data, PackStringID)
@@ -130,34 +304,456 @@ func decodeUint64(data io.Reader) (uint64, error) {
 	return binary.BigEndian.Uint64(encoded[1:]), nil
 }
 
-func decodeStruct(data io.Reader, o interface{}) (err error) {
-	// Take the value of the interface{} object
-	v := reflect.ValueOf(o)
+func decodeInt64(data io.Reader) (int64, error) {
+	// Read in the 9-byte encoded int64
+	var encoded [9]byte
+	_, err := io.ReadFull(data, encoded[:])
+	if err != nil {
+		return 0, ErrBufTooShort
+	}
+
+	// Ensure we got the expected type. We only ever encode signed integers as
+	// int64, so any other integer representation is non-canonical
+	if encoded[0] != PackInt64ID {
+		return 0, fmt.Errorf("got wrong header byte %x, wanted %x", encoded[0], PackInt64ID)
+	}
+
+	// Decode the int64
+	return int64(binary.BigEndian.Uint64(encoded[1:])), nil
+}
+
+func decodeFloat32(data io.Reader) (float32, error) {
+	// Read in the 5-byte encoded float32
+	var encoded [5]byte
+	_, err := io.ReadFull(data, encoded[:])
+	if err != nil {
+		return 0, ErrBufTooShort
+	}
+
+	// Ensure we got the expected type
+	if encoded[0] != PackFloat32ID {
+		return 0, fmt.Errorf("got wrong header byte %x, wanted %x", encoded[0], PackFloat32ID)
+	}
+
+	// Decode the float32, ensuring any NaN uses the canonical bit pattern
+	bits := binary.BigEndian.Uint32(encoded[1:])
+	f := math.Float32frombits(bits)
+	if math.IsNaN(float64(f)) && bits != CanonicalNaN32 {
+		return 0, fmt.Errorf("got non-canonical NaN %x", bits)
+	}
+
+	return f, nil
+}
+
+func decodeFloat64(data io.Reader) (float64, error) {
+	// Read in the 9-byte encoded float64
+	var encoded [9]byte
+	_, err := io.ReadFull(data, encoded[:])
+	if err != nil {
+		return 0, ErrBufTooShort
+	}
+
+	// Ensure we got the expected type
+	if encoded[0] != PackFloat64ID {
+		return 0, fmt.Errorf("got wrong header byte %x, wanted %x", encoded[0], PackFloat64ID)
+	}
+
+	// Decode the float64, ensuring any NaN uses the canonical bit pattern
+	bits := binary.BigEndian.Uint64(encoded[1:])
+	f := math.Float64frombits(bits)
+	if math.IsNaN(f) && bits != CanonicalNaN64 {
+		return 0, fmt.Errorf("got non-canonical NaN %x", bits)
+	}
+
+	return f, nil
+}
+
+func decodeTimestamp(data io.Reader) (PackTimestamp, error) {
+	// Read in the 3-byte extension header
+	var header [3]byte
+	_, err := io.ReadFull(data, header[:])
+	if err != nil {
+		return PackTimestamp{}, ErrBufTooShort
+	}
+
+	// Ensure we got the expected type. We only ever encode timestamps using the
+	// 96-bit format, so any other width is non-canonical
+	if header[0] != PackExt8ID {
+		return PackTimestamp{}, fmt.Errorf("got wrong header byte %x, wanted %x", header[0], PackExt8ID)
+	}
+	if header[1] != PackTimestampLen {
+		return PackTimestamp{}, fmt.Errorf("got timestamp of length %d, wanted %d", header[1], PackTimestampLen)
+	}
+	if int8(header[2]) != PackTimestampExtType {
+		return PackTimestamp{}, fmt.Errorf("got extension type %d, wanted %d", int8(header[2]), PackTimestampExtType)
+	}
+
+	// Read in the 12-byte timestamp
+	var encoded [PackTimestampLen]byte
+	_, err = io.ReadFull(data, encoded[:])
+	if err != nil {
+		return PackTimestamp{}, ErrBufTooShort
+	}
+
+	// Decode the timestamp, ensuring nanoseconds are in range
+	ts := PackTimestamp{
+		Nanoseconds: binary.BigEndian.Uint32(encoded[0:4]),
+		Seconds:     int64(binary.BigEndian.Uint64(encoded[4:])),
+	}
+	if ts.Nanoseconds >= 1e9 {
+		return PackTimestamp{}, fmt.Errorf("timestamp nanoseconds %d out of range", ts.Nanoseconds)
+	}
+
+	return ts, nil
+}
+
+func decodeBool(data io.Reader) (bool, error) {
+	// Read in the single encoded byte
+	var encoded [1]byte
+	_, err := io.ReadFull(data, encoded[:])
+	if err != nil {
+		return false, ErrBufTooShort
+	}
+
+	// Only the msgpack true and false bytes are valid
+	switch encoded[0] {
+	case PackTrueID:
+		return true, nil
+	case PackFalseID:
+		return false, nil
+	default:
+		return false, fmt.Errorf("got wrong header byte %x, wanted %x or %x", encoded[0], PackFalseID, PackTrueID)
+	}
+}
+
+// decodePackValue decodes any value we know how to encode into our internal
+// representation, without needing a Go type to decode into. This is used to
+// feed Unmarshalers, so it enforces the same limits from ezst that decodeValue
+// would
+func decodePackValue(data io.Reader, ezst ezPackStructTag) (PackValue, error) {
+	// Read the type identifier, and put it back for the specific decoder
+	var marker [1]byte
+	_, err := io.ReadFull(data, marker[:])
+	if err != nil {
+		return nil, ErrBufTooShort
+	}
+	rest := io.MultiReader(bytes.NewReader(marker[:]), data)
+
+	switch marker[0] {
+	case PackNilID:
+		return PackNil{}, nil
+	case PackFalseID, PackTrueID:
+		return PackBool{
+			Value: marker[0] == PackTrueID,
+		}, nil
+	case PackUint64ID:
+		dec, err := decodeUint64(rest)
+		if err != nil {
+			return nil, err
+		}
+		return PackUint64{
+			Value: dec,
+		}, nil
+	case PackInt64ID:
+		dec, err := decodeInt64(rest)
+		if err != nil {
+			return nil, err
+		}
+		return PackInt64{
+			Value: dec,
+		}, nil
+	case PackFloat32ID:
+		dec, err := decodeFloat32(rest)
+		if err != nil {
+			return nil, err
+		}
+		err = checkCanonicalFloat(float64(dec), ezst)
+		if err != nil {
+			return nil, err
+		}
+		return PackFloat32{
+			Value: dec,
+		}, nil
+	case PackFloat64ID:
+		dec, err := decodeFloat64(rest)
+		if err != nil {
+			return nil, err
+		}
+		err = checkCanonicalFloat(dec, ezst)
+		if err != nil {
+			return nil, err
+		}
+		return PackFloat64{
+			Value: dec,
+		}, nil
+	case PackExt8ID:
+		return decodeTimestamp(rest)
+	case PackExt32ID:
+		dec, err := decodePackExt(rest, ezst.MaxLen)
+		if err != nil {
+			return nil, err
+		}
+		if dec.Type < 0 {
+			return nil, fmt.Errorf("extension type %d is reserved", dec.Type)
+		}
+		return dec, nil
+	case PackBytesID:
+		dec, err := decodeByteSlice(rest, ezst.MaxLen)
+		if err != nil {
+			return nil, err
+		}
+		return PackBytes{
+			Bytes: dec,
+		}, nil
+	case PackStringID:
+		dec, err := decodeString(rest, ezst.MaxLen)
+		if err != nil {
+			return nil, err
+		}
+		return PackString{
+			String: dec,
+		}, nil
+	case PackArrayID:
+		// Decode header and enforce maximum length
+		length, err := decodeCommonHeader(rest, PackArrayID)
+		if err != nil {
+			return nil, err
+		}
+		err = checkMaxLength(length, ezst.MaxLen)
+		if err != nil {
+			return nil, err
+		}
+
+		// Decode each element. This cast is OK because checkMaxLength ensures
+		// length <= math.MaxInt32
+		elTag := ezst.elemTag()
+		dec := PackValueSlice{
+			Values: make([]PackValue, 0, int(length)),
+		}
+		for i := 0; i < int(length); i++ {
+			pv, err := decodePackValue(rest, elTag)
+			if err != nil {
+				return nil, fmt.Errorf("error decoding index %d: %w", i, err)
+			}
+			dec.Values = append(dec.Values, pv)
+		}
+
+		return dec, nil
+	case PackMapID:
+		// Decode header and enforce maximum number of entries
+		length, err := decodeCommonHeader(rest, PackMapID)
+		if err != nil {
+			return nil, err
+		}
+		err = checkMaxLength(length, ezst.MaxLen)
+		if err != nil {
+			return nil, err
+		}
+
+		// Decode each key/value pair. This cast is OK because checkMaxLength
+		// ensures length <= math.MaxInt32
+		elTag := ezst.elemTag()
+		dec := PackMap{
+			Elements: make([]PackMapElement, 0, int(length)),
+		}
+		for i := 0; i < int(length); i++ {
+			// Decode the key, which must be strictly increasing
+			key, err := decodeString(rest, ezst.KeyMaxLen)
+			if err != nil {
+				return nil, err
+			}
+			if i > 0 {
+				err = checkKeyOrder(dec.Elements[i-1].Key.String, key)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			// Decode the value
+			pv, err := decodePackValue(rest, elTag)
+			if err != nil {
+				return nil, fmt.Errorf("error decoding key '%s': %w", key, err)
+			}
+
+			// Add the new map element
+			dec.Elements = append(dec.Elements, PackMapElement{
+				Key: PackString{
+					String: key,
+				},
+				Value: pv,
+			})
+		}
+
+		return dec, nil
+	default:
+		return nil, fmt.Errorf("got unknown header byte %x", marker[0])
+	}
+}
+
+// unmarshalerFor returns v as an Unmarshaler if its type implements it (with a
+// pointer receiver, so v must be addressable)
+func unmarshalerFor(v reflect.Value) (Unmarshaler, bool) {
+	if !v.CanAddr() {
+		return nil, false
+	}
+
+	i, ok := methodReceiver(v, unmarshalerType)
+	if !ok {
+		return nil, false
+	}
+
+	return i.(Unmarshaler), true
+}
+
+// customUnmarshal decodes any value from data and passes it to
+// UnmarshalEzpack on u, which is v as an Unmarshaler. The limits in ezst are
+// enforced before unmarshaling
+func customUnmarshal(data io.Reader, v reflect.Value, u Unmarshaler, ezst ezPackStructTag) error {
+	pv, err := decodePackValue(data, ezst)
+	if err != nil {
+		return err
+	}
 
-	// Dereference once if passed pointer
-	if v.Kind() == reflect.Ptr {
-		// Elem returns the value that the pointer points to
-		v = v.Elem()
+	err = u.UnmarshalEzpack(pv)
+	if err != nil {
+		return err
+	}
+
+	// Many types accept more than one form of the same value (e.g. "01.002"
+	// for "1.2"), so ensure that marshaling again gives back what was on the
+	// wire. Types that can only be unmarshaled are trusted
+	m, ok := marshalerFor(v)
+	if !ok {
+		return nil
+	}
+
+	repv, err := m.MarshalEzpack()
+	if err != nil {
+		return err
+	}
+
+	enc, err := pv.Encode()
+	if err != nil {
+		return err
+	}
+
+	reenc, err := repv.Encode()
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(reenc, enc) {
+		return fmt.Errorf("got non-canonical encoding of %s", v.Type())
+	}
+
+	return nil
+}
+
+// stdUnmarshal decodes bytes or a string from data and passes them to
+// UnmarshalBinary or UnmarshalText on v, as selected by the binary or text
+// option in ezst. The max length is enforced before unmarshaling. ok is false
+// (and nothing is read) if v doesn't implement the selected interface
+func stdUnmarshal(data io.Reader, v reflect.Value, ezst ezPackStructTag) (ok bool, err error) {
+	if !v.CanAddr() {
+		return false, nil
+	}
+
+	iface := textUnmarshalerType
+	if ezst.Binary {
+		iface = binaryUnmarshalerType
+	}
+	i, ok := methodReceiver(v, iface)
+	if !ok {
+		return false, nil
+	}
+
+	var enc []byte
+	if ezst.Binary {
+		enc, err = decodeByteSlice(data, ezst.MaxLen)
+		if err != nil {
+			return true, err
+		}
+
+		err = i.(encoding.BinaryUnmarshaler).UnmarshalBinary(enc)
+	} else {
+		var dec string
+		dec, err = decodeString(data, ezst.MaxLen)
+		if err != nil {
+			return true, err
+		}
+
+		enc = []byte(dec)
+		err = i.(encoding.TextUnmarshaler).UnmarshalText(enc)
+	}
+	if err != nil {
+		return true, err
 	}
 
+	// Many types accept more than one form of the same value (e.g. "007" for
+	// 7), so ensure that marshaling again gives back what was on the wire
+	reenc, ok, err := stdMarshal(v, ezst)
+	if err != nil {
+		return true, err
+	}
+	if ok && !bytes.Equal(reenc, enc) {
+		return true, fmt.Errorf("got non-canonical encoding of %s", v.Type())
+	}
+
+	return true, nil
+}
+
+// decodeState holds state shared across a single call to Decode
+type decodeState struct {
+	// depth is how many values we are currently nested inside
+	depth int
+}
+
+func newDecodeState() *decodeState {
+	return &decodeState{}
+}
+
+// enter records that we are decoding one level deeper, returning ErrMaxDepth
+// if that is too deep. Callers must call leave when done
+func (ds *decodeState) enter() error {
+	if ds.depth >= maxDecodeDepth {
+		return ErrMaxDepth
+	}
+
+	ds.depth++
+	return nil
+}
+
+// leave undoes a successful call to enter
+func (ds *decodeState) leave() {
+	ds.depth--
+}
+
+func decodeStruct(data io.Reader, v reflect.Value, ds *decodeState) (err error) {
 	// At this point we should have a struct
 	if v.Kind() != reflect.Struct {
 		return fmt.Errorf("Decode requires struct, not %s", v.Kind())
 	}
 
+	// Structs with code generated by ezpackgen decode themselves
+	if g, ok := generatedDecoderFor(v); ok {
+		return g.DecodeEzpack(ds, data)
+	}
+
 	// Type returns the user-defined struct type
 	t := v.Type()
 
 	/*
 	 * 1. Decode Map Header
 	 * We are decoding a struct, so this should be a map with as many entries
-	 * as this struct has fields.
+	 * as this struct has fields (after flattening any inline structs).
 	 */
 
-	// Sanity check that we're not decoding too many fields
-	numFields := v.NumField()
-	if (numFields <= 0) || (numFields > math.MaxInt32) {
-		return fmt.Errorf("cannot decode massive struct or struct with no fields")
+	// Fetch this struct's fields, sorted so we know what order we should expect
+	// things on the wire. This also checks that we're not decoding too many
+	// fields. Structs with no fields are fine, they are just an empty map
+	fields, err := planFor(t)
+	if err != nil {
+		return err
 	}
 
 	// Decode the header
@@ -166,18 +762,12 @@ func decodeStruct(data io.Reader, o interface{}) (err error) {
 		return err
 	}
 
-	// Check that the map has the expected number of entries
-	if mapLen != uint32(numFields) {
+	// Check that the map has the expected number of entries. This cast is OK
+	// because sortStructFields ensures len(fields) <= math.MaxInt32
+	if mapLen != uint32(len(fields)) {
 		return fmt.Errorf("got wrong map size for struct %s when decoding map", t.Name())
 	}
 
-	// Sort this struct's fields so we know what order we should expect things
-	// on the wire
-	parsedFields, err := sortStructFields(t)
-	if err != nil {
-		return err
-	}
-
 	/*
 	 * 2. Decode Map key/value pairs and map to struct fields
 	 * Decode a string, ensure it matches the name specified in the struct tag,
@@ -185,16 +775,13 @@ func decodeStruct(data io.Reader, o interface{}) (err error) {
 	 */
 
 	// Iterate over the struct's fields, and decode an appropriate type for each
-	for _, parsedField := range parsedFields {
-		// Fetch the StructField from the type (info like name, struct tag, etc.)
-		structField := t.Field(parsedField.offset)
-
+	for _, field := range fields {
 		// Fetch the value of the field
-		fieldValue := v.Field(parsedField.offset)
+		fieldValue := v.FieldByIndex(field.index)
 
 		// Ensure we can set this field
 		if !fieldValue.CanSet() {
-			return fmt.Errorf("Decode cannot set value of %s, did you pass a non-pointer?", structField.Name)
+			return fmt.Errorf("Decode cannot set value of %s, did you pass a non-pointer?", field.goName)
 		}
 
 		// Read a string, it should be the name specified in the struct tag
@@ -205,164 +792,417 @@ func decodeStruct(data io.Reader, o interface{}) (err error) {
 		}
 
 		// Check that the name matches the expected value
-		expectedName := parsedField.parsedStructTag.FieldName
+		expectedName := field.parsedStructTag.FieldName
 		if allegedName != expectedName {
 			return fmt.Errorf("got unexpected field name on wire, wanted %s", expectedName)
 		}
 
-		// Decode each field type we know about
-		switch kind := structField.Type.Kind(); kind {
-		case reflect.Array:
-			// We only support arrays of byte or uint8
-			elType := structField.Type.Elem()
-			elKind := elType.Kind()
-			if elKind != reflect.Uint8 {
-				return fmt.Errorf("only arrays of byte or uint8 are supported")
-			}
+		// Decode the value into the field
+		err = field.decode(data, fieldValue, ds)
+		if err != nil {
+			return fmt.Errorf("error decoding '%s': %w", expectedName, err)
+		}
+	}
 
-			// Decode slice of byte or uint8
-			var dec []byte
-			dec, err = decodeByteSlice(data, parsedField.parsedStructTag.MaxLen)
-			if err != nil {
-				return fmt.Errorf("error decoding '%s': %s", expectedName, err)
-			}
+	return
+}
+
+// decodeValue decodes a value from data into v according to v's type. v must
+// be settable, and ezst holds the struct tag parameters of the field v came from
+func decodeValue(data io.Reader, v reflect.Value, ezst ezPackStructTag, ds *decodeState) (err error) {
+	// Fields tagged binary or text are carried as bytes or a string using the
+	// standard library's marshaling interfaces
+	if ezst.Binary || ezst.Text {
+		var ok bool
+		ok, err = stdUnmarshal(data, v, ezst)
+		if ok {
+			return err
+		}
 
-			// Length should be exact for arrays
-			expectedLen := fieldValue.Len()
-			if len(dec) != expectedLen {
-				return fmt.Errorf("expected array of length %d, got %d", expectedLen, len(dec))
+		// Otherwise the option must apply to the pointee or elements of v
+		switch v.Kind() {
+		case reflect.Ptr, reflect.Map, reflect.Array, reflect.Slice:
+		default:
+			iface := "encoding.TextUnmarshaler"
+			if ezst.Binary {
+				iface = "encoding.BinaryUnmarshaler"
 			}
+			return fmt.Errorf("%s does not implement %s", v.Type(), iface)
+		}
+	}
 
-			// Create output array
-			arrayType := reflect.ArrayOf(expectedLen, elType)
-			decArrayPtr := reflect.New(arrayType)
-			decArray := reflect.Indirect(decArrayPtr)
-			for i := 0; i < expectedLen; i++ {
-				// Ensure we can set the ith entry of the output array
-				arrayEntry := decArray.Index(i)
-				if !arrayEntry.CanSet() {
-					return fmt.Errorf("Decode cannot call Set() on %v[%d]", structField.Name, i)
-				}
+	// Registered extension types are encoded as msgpack extensions
+	if et, ok := lookupExt(v.Type()); ok {
+		return et.decodeExt(data, v)
+	}
+
+	// Types that know how to unmarshal themselves take priority over their kind
+	if u, ok := unmarshalerFor(v); ok {
+		return customUnmarshal(data, v, u, ezst)
+	}
+
+	return decodeKind(data, v, ezst, ds)
+}
+
+// decodeKind decodes a value from data into v according to v's kind alone,
+// without checking for extension types or unmarshaling interfaces. v must be
+// settable, and ezst holds the struct tag parameters of the field v came from
+func decodeKind(data io.Reader, v reflect.Value, ezst ezPackStructTag, ds *decodeState) (err error) {
+	// Every level of nesting passes through here
+	err = ds.enter()
+	if err != nil {
+		return err
+	}
+	defer ds.leave()
+
+	switch kind := v.Kind(); kind {
+	case reflect.Ptr:
+		// Only pointers to values that can't be nil are supported
+		err = checkPointerType(v.Type())
+		if err != nil {
+			return err
+		}
+
+		// Read the first byte to see if this is nil
+		var marker [1]byte
+		_, err = io.ReadFull(data, marker[:])
+		if err != nil {
+			return ErrBufTooShort
+		}
+
+		// If we got nil, clear the pointer and we're done
+		if marker[0] == PackNilID {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+
+		// Otherwise allocate the pointee and decode into it, putting back the
+		// byte we consumed
+		ptr := reflect.New(v.Type().Elem())
+		rest := io.MultiReader(bytes.NewReader(marker[:]), data)
+		err = decodeValue(rest, ptr.Elem(), ezst, ds)
+		if err != nil {
+			return err
+		}
+
+		// Set the value to be the pointer to the decoded value
+		v.Set(ptr)
+	case reflect.Map:
+		// We only support maps with string keys
+		keyType := v.Type().Key()
+		if keyType.Kind() != reflect.String {
+			return fmt.Errorf("can only decode maps with string keys, not %s", keyType.Kind())
+		}
+
+		// Decode header
+		var length uint32
+		length, err = decodeCommonHeader(data, PackMapID)
+		if err != nil {
+			return err
+		}
 
-				// Set the entry at i to the decoded byte
-				arrayEntry.Set(reflect.ValueOf(dec[i]))
+		// Enforce maximum number of entries
+		err = checkMaxLength(length, ezst.MaxLen)
+		if err != nil {
+			return err
+		}
+
+		// This cast is OK because checkMaxLength ensures length <= math.MaxInt32
+		ilen := int(length)
+
+		// Decode each key/value pair into a new map
+		elTag := ezst.elemTag()
+		elType := v.Type().Elem()
+		dec := reflect.MakeMapWithSize(v.Type(), ilen)
+		var lastKey string
+		for i := 0; i < ilen; i++ {
+			// Decode the key
+			var key string
+			key, err = decodeString(data, ezst.KeyMaxLen)
+			if err != nil {
+				return err
 			}
 
-			// Set the value to be the decoded byte array
-			fieldValue.Set(decArray)
-		case reflect.Slice:
-			// Got a slice, check if it's a slice of bytes or structs
-			elType := structField.Type.Elem()
-			elKind := elType.Kind()
-
-			switch elKind {
-			case reflect.Uint8:
-				// Decode slice of byte or uint8
-				var dec []byte
-				dec, err = decodeByteSlice(data, parsedField.parsedStructTag.MaxLen)
+			// Keys must be strictly increasing
+			if i > 0 {
+				err = checkKeyOrder(lastKey, key)
 				if err != nil {
-					return fmt.Errorf("error decoding '%s': %s", expectedName, err)
+					return err
 				}
+			}
+			lastKey = key
 
-				// Set the value to be the decoded byte slice
-				fieldValue.SetBytes(dec)
-			case reflect.Struct:
-				// Decode header
-				var length uint32
-				length, err = decodeCommonHeader(data, PackArrayID)
-				if err != nil {
-					return fmt.Errorf("error decoding '%s': %s", expectedName, err)
-				}
+			// Decode the value
+			elem := reflect.New(elType).Elem()
+			err = decodeValue(data, elem, elTag, ds)
+			if err != nil {
+				return fmt.Errorf("error decoding key '%s': %w", key, err)
+			}
 
-				// Enforce maximum length
-				err = checkMaxLength(length, parsedField.parsedStructTag.MaxLen)
-				if err != nil {
-					return fmt.Errorf("error decoding '%s': %s", expectedName, err)
-				}
+			// Add the entry to the map
+			dec.SetMapIndex(reflect.ValueOf(key).Convert(keyType), elem)
+		}
 
-				// Make sure it's safe to cast to int on 32-bit platforms
-				if length > math.MaxInt32 {
-					return fmt.Errorf("error decoding '%s': length %d overflows 32-bit signed integers", expectedName, length)
-				}
+		// Set the value to be the decoded map
+		v.Set(dec)
+	case reflect.Array:
+		// Arrays of anything other than bytes are encoded as msgpack arrays
+		elType := v.Type().Elem()
+		if elType.Kind() != reflect.Uint8 {
+			// Decode header
+			var length uint32
+			length, err = decodeCommonHeader(data, PackArrayID)
+			if err != nil {
+				return err
+			}
 
-				// This cast is OK because we just checked that length <= math.MaxInt32
-				ilen := int(length)
-
-				// Create slice of structs
-				dec := reflect.MakeSlice(structField.Type, ilen, ilen)
-				for i := 0; i < ilen; i++ {
-					// Ensure we can make a pointer to this slice entry
-					sliceEntry := dec.Index(i)
-					if !sliceEntry.CanAddr() {
-						return fmt.Errorf("Decode cannot call Addr() on %v[%d]", structField.Name, i)
-					}
-
-					// Make a pointer to this slice entry
-					entryAddr := sliceEntry.Addr()
-
-					// Ensure we can convert the pointer to this slice entry to an
-					// interface, which we need for decodeStruct
-					if !entryAddr.CanInterface() {
-						return fmt.Errorf("could not convert &%v[%d] to interface", structField.Name, i)
-					}
-
-					// Decode struct in place
-					err = decodeStruct(data, entryAddr.Interface())
-					if err != nil {
-						return fmt.Errorf("error decoding '%s': %s", expectedName, err)
-					}
-				}
+			// The Go type bounds the length, so it should be exact
+			if length != uint32(v.Len()) {
+				return fmt.Errorf("expected array of length %d, got %d", v.Len(), length)
+			}
 
-				// Set the value to be the decoded struct slice
-				fieldValue.Set(dec)
-			default:
-				return fmt.Errorf("can only decode slices of byte, uint8, or struct, not %s", elKind)
+			// Decode each element in place, using the element parameters from
+			// the tag
+			elTag := ezst.elemTag()
+			for i := 0; i < v.Len(); i++ {
+				err = decodeValue(data, v.Index(i), elTag, ds)
+				if err != nil {
+					return fmt.Errorf("error decoding index %d: %w", i, err)
+				}
 			}
 
-		case reflect.String:
-			// Decode string
-			var dec string
-			dec, err = decodeString(data, parsedField.parsedStructTag.MaxLen)
+			return nil
+		}
+
+		// Decode byte array straight into v. The Go type bounds the length, so
+		// no max length is needed in the struct tag
+		err = decodeByteArray(data, v.Slice(0, v.Len()).Bytes())
+		if err != nil {
+			return err
+		}
+	case reflect.Slice:
+		// Byte slices are encoded as msgpack bin
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			// Decode slice of byte or uint8
+			var dec []byte
+			dec, err = decodeByteSlice(data, ezst.MaxLen)
 			if err != nil {
-				return fmt.Errorf("error decoding '%s': %s", expectedName, err)
+				return err
 			}
 
-			// Set the value to be the decoded string
-			fieldValue.SetString(dec)
-		case reflect.Uint64:
-			// Decode uint64
-			var dec uint64
-			dec, err = decodeUint64(data)
+			// Set the value to be the decoded byte slice
+			v.SetBytes(dec)
+			return nil
+		}
+
+		// Anything else is encoded as a msgpack array. Decode header
+		var length uint32
+		length, err = decodeCommonHeader(data, PackArrayID)
+		if err != nil {
+			return err
+		}
+
+		// Enforce maximum length
+		err = checkMaxLength(length, ezst.MaxLen)
+		if err != nil {
+			return err
+		}
+
+		// This cast is OK because checkMaxLength ensures length <= math.MaxInt32
+		ilen := int(length)
+
+		// Create the slice and decode each element in place, using the element
+		// parameters from the tag
+		elTag := ezst.elemTag()
+		dec := reflect.MakeSlice(v.Type(), ilen, ilen)
+		for i := 0; i < ilen; i++ {
+			err = decodeValue(data, dec.Index(i), elTag, ds)
 			if err != nil {
-				return fmt.Errorf("error decoding '%s': %s", expectedName, err)
+				return fmt.Errorf("error decoding index %d: %w", i, err)
 			}
+		}
 
-			// Set the value to be the decoded uint64
-			fieldValue.SetUint(dec)
-		case reflect.Struct:
-			// Ensure we can make a pointer to this field
-			if !fieldValue.CanAddr() {
-				return fmt.Errorf("Decode cannot call Addr() on %v", structField.Name)
-			}
+		// Set the value to be the decoded slice
+		v.Set(dec)
+	case reflect.String:
+		// Decode string
+		var dec string
+		dec, err = decodeString(data, ezst.MaxLen)
+		if err != nil {
+			return err
+		}
+
+		// Set the value to be the decoded string
+		v.SetString(dec)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		// Decode uint64
+		var dec uint64
+		dec, err = decodeUint64(data)
+		if err != nil {
+			return err
+		}
+
+		// Ensure the decoded value fits in the destination. This also covers
+		// uint, which is only 32 bits wide on 32-bit platforms
+		if v.OverflowUint(dec) {
+			return fmt.Errorf("value %d overflows %s", dec, kind)
+		}
+
+		// Set the value to be the decoded uint64
+		v.SetUint(dec)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		// Decode int64
+		var dec int64
+		dec, err = decodeInt64(data)
+		if err != nil {
+			return err
+		}
+
+		// Ensure the decoded value fits in the destination
+		if v.OverflowInt(dec) {
+			return fmt.Errorf("value %d overflows %s", dec, kind)
+		}
+
+		// Set the value to be the decoded int64
+		v.SetInt(dec)
+	case reflect.Float32, reflect.Float64:
+		// Decode a float of the same width as the destination
+		var dec float64
+		if kind == reflect.Float32 {
+			var dec32 float32
+			dec32, err = decodeFloat32(data)
+			dec = float64(dec32)
+		} else {
+			dec, err = decodeFloat64(data)
+		}
+		if err != nil {
+			return err
+		}
 
-			// Make a pointer to this field
-			valueAddr := fieldValue.Addr()
+		// Ensure the value is allowed by the float policy
+		err = checkCanonicalFloat(dec, ezst)
+		if err != nil {
+			return err
+		}
 
-			// Ensure we can convert the pointer to this field to an interface, which
-			// we need for decodeStruct
-			if !valueAddr.CanInterface() {
-				return fmt.Errorf("could not convert %s to interface", structField.Name)
+		// Set the value to be the decoded float
+		v.SetFloat(dec)
+	case reflect.Bool:
+		// Decode bool
+		var dec bool
+		dec, err = decodeBool(data)
+		if err != nil {
+			return err
+		}
+
+		// Set the value to be the decoded bool
+		v.SetBool(dec)
+	case reflect.Struct:
+		// time.Time is encoded as a msgpack timestamp
+		if v.Type() == timeType {
+			var dec PackTimestamp
+			dec, err = decodeTimestamp(data)
+			if err != nil {
+				return err
 			}
 
-			// Decode struct
-			err = decodeStruct(data, valueAddr.Interface())
+			// Set the value to be the decoded time, always in UTC
+			t := time.Unix(dec.Seconds, int64(dec.Nanoseconds)).UTC()
+			v.Set(reflect.ValueOf(t))
+			return nil
+		}
+
+		// big.Int is encoded as bin holding a sign byte and minimal magnitude
+		if v.Type() == bigIntType {
+			var dec *big.Int
+			dec, err = decodeBigInt(data, ezst.MaxLen)
 			if err != nil {
-				return fmt.Errorf("error decoding '%s': %s", expectedName, err)
+				return err
 			}
-		default:
-			return fmt.Errorf("decode does not know how to decode into %s", kind)
+
+			// Set the value to be the decoded integer
+			v.Set(reflect.ValueOf(dec).Elem())
+			return nil
 		}
+
+		// Decode struct in place
+		return decodeStruct(data, v, ds)
+	case reflect.Interface:
+		// Interfaces are only supported as tagged unions
+		if !ezst.Union {
+			return fmt.Errorf("interface fields require the union option")
+		}
+		return decodeUnion(data, v, ds)
+	default:
+		return fmt.Errorf("decode does not know how to decode into %s", kind)
 	}
 
-	return
+	return nil
+}
+
+// decodeUnion decodes a tagged union from data into the interface value v,
+// whose type must be registered with RegisterUnion. Only registered variant
+// names are accepted
+func decodeUnion(data io.Reader, v reflect.Value, ds *decodeState) error {
+	ut, err := lookupUnion(v.Type())
+	if err != nil {
+		return err
+	}
+
+	// Read the first byte to see if this is nil
+	var marker [1]byte
+	_, err = io.ReadFull(data, marker[:])
+	if err != nil {
+		return ErrBufTooShort
+	}
+
+	// If we got nil, clear the interface and we're done
+	if marker[0] == PackNilID {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+
+	// Otherwise we should have a two-element array, putting back the byte we
+	// consumed
+	rest := io.MultiReader(bytes.NewReader(marker[:]), data)
+	length, err := decodeCommonHeader(rest, PackArrayID)
+	if err != nil {
+		return err
+	}
+	if length != 2 {
+		return fmt.Errorf("got union of length %d, wanted 2", length)
+	}
+
+	// Decode the variant name and look up its type
+	name, err := decodeString(rest, maxTagFieldNameLength)
+	if err != nil {
+		return err
+	}
+	variant, ok := ut.byName[name]
+	if !ok {
+		return &UnknownVariantError{
+			Interface: ut.iface,
+			Name:      name,
+		}
+	}
+
+	// Decode the variant into a new struct
+	structType := variant
+	if variant.Kind() == reflect.Ptr {
+		structType = variant.Elem()
+	}
+	dec := reflect.New(structType)
+	err = decodeStruct(rest, dec.Elem(), ds)
+	if err != nil {
+		return fmt.Errorf("error decoding variant '%s': %w", name, err)
+	}
+
+	// Set the value to be the decoded variant
+	if variant.Kind() == reflect.Ptr {
+		v.Set(dec)
+	} else {
+		v.Set(dec.Elem())
+	}
+
+	return nil
 }
@@ -1,8 +1,22 @@
 package ezpack
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net"
+	"net/url"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/justicz/ezpack/internal/genhooks"
 	"github.com/stretchr/testify/require"
 )
 
@@ -114,3 +128,1863 @@ func TestCannotDecodeBeyondMaxLen(t *testing.T) {
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "max is 3")
 }
+
+func TestCanEncodeDecodeSignedInts(t *testing.T) {
+	type Struct struct {
+		Foo int64 `ezpack:"foo"`
+		Bar int16 `ezpack:"bar"`
+		Baz int   `ezpack:"baz"`
+	}
+
+	s := Struct{
+		Foo: -(1 << 63),
+		Bar: -(1 << 15),
+		Baz: -1234,
+	}
+
+	enc, err := Encode(s)
+	require.NoError(t, err)
+
+	var res Struct
+	err = DecodeBytes(enc, &res)
+	require.NoError(t, err)
+
+	require.Equal(t, res, s)
+}
+
+func TestCannotDecodeOverflowingOrNonCanonicalInts(t *testing.T) {
+	type Wide struct {
+		X int64 `ezpack:"x"`
+	}
+
+	type Narrow struct {
+		X int8 `ezpack:"x"`
+	}
+
+	type Unsigned struct {
+		X uint64 `ezpack:"x"`
+	}
+
+	enc, err := Encode(Wide{X: 128})
+	require.NoError(t, err)
+
+	// Value does not fit in an int8
+	var narrow Narrow
+	err = DecodeBytes(enc, &narrow)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "overflows")
+
+	// A uint64 on the wire is not a canonical signed integer
+	enc, err = Encode(Unsigned{X: 1})
+	require.NoError(t, err)
+
+	var wide Wide
+	err = DecodeBytes(enc, &wide)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "wrong header byte")
+}
+
+func TestCanEncodeDecodeNarrowUnsigned(t *testing.T) {
+	type Struct struct {
+		Foo uint32 `ezpack:"foo"`
+		Bar uint16 `ezpack:"bar"`
+		Baz uint8  `ezpack:"baz"`
+		Biz uint   `ezpack:"biz"`
+	}
+
+	s := Struct{
+		Foo: (1 << 32) - 1,
+		Bar: (1 << 16) - 1,
+		Baz: (1 << 8) - 1,
+		Biz: (1 << 32) - 1,
+	}
+
+	enc, err := Encode(s)
+	require.NoError(t, err)
+
+	var res Struct
+	err = DecodeBytes(enc, &res)
+	require.NoError(t, err)
+
+	require.Equal(t, res, s)
+}
+
+func TestCannotDecodeOverflowingUnsigned(t *testing.T) {
+	type Wide struct {
+		X uint64 `ezpack:"x"`
+	}
+
+	type Narrow struct {
+		X uint16 `ezpack:"x"`
+	}
+
+	enc, err := Encode(Wide{X: 1 << 16})
+	require.NoError(t, err)
+
+	var res Narrow
+	err = DecodeBytes(enc, &res)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "overflows")
+}
+
+func TestCanEncodeDecodeBools(t *testing.T) {
+	type Struct struct {
+		Foo bool `ezpack:"foo"`
+		Bar bool `ezpack:"bar"`
+	}
+
+	s := Struct{
+		Foo: true,
+		Bar: false,
+	}
+
+	enc, err := Encode(s)
+	require.NoError(t, err)
+
+	var res Struct
+	err = DecodeBytes(enc, &res)
+	require.NoError(t, err)
+
+	require.Equal(t, res, s)
+}
+
+func TestCannotDecodeInvalidBool(t *testing.T) {
+	type Struct struct {
+		X bool `ezpack:"x"`
+	}
+
+	enc, err := Encode(Struct{X: true})
+	require.NoError(t, err)
+
+	// Corrupt the final byte, which holds the bool
+	enc[len(enc)-1] = 0x01
+
+	var res Struct
+	err = DecodeBytes(enc, &res)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "wrong header byte")
+}
+
+func TestCanEncodeDecodeFloats(t *testing.T) {
+	type Struct struct {
+		Foo float64 `ezpack:"foo"`
+		Bar float32 `ezpack:"bar"`
+		Baz float64 `ezpack:"baz"`
+	}
+
+	s := Struct{
+		Foo: math.Pi,
+		Bar: -1.5,
+		Baz: math.Inf(-1),
+	}
+
+	enc, err := Encode(s)
+	require.NoError(t, err)
+
+	var res Struct
+	err = DecodeBytes(enc, &res)
+	require.NoError(t, err)
+
+	require.Equal(t, res, s)
+}
+
+func TestNaNIsEncodedCanonically(t *testing.T) {
+	type Struct struct {
+		X float64 `ezpack:"x"`
+	}
+
+	// Different NaN payloads should produce identical encodings
+	enc1, err := Encode(Struct{X: math.NaN()})
+	require.NoError(t, err)
+
+	enc2, err := Encode(Struct{X: math.Float64frombits(0x7FF0000000000123)})
+	require.NoError(t, err)
+
+	require.Equal(t, enc1, enc2)
+
+	var res Struct
+	err = DecodeBytes(enc1, &res)
+	require.NoError(t, err)
+	require.True(t, math.IsNaN(res.X))
+
+	// A NaN with a non-canonical payload should be rejected
+	binary.BigEndian.PutUint64(enc1[len(enc1)-8:], 0x7FF0000000000123)
+	err = DecodeBytes(enc1, &res)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "non-canonical NaN")
+}
+
+func TestFloatTagOptions(t *testing.T) {
+	type Plain struct {
+		X float64 `ezpack:"x"`
+	}
+
+	type Strict struct {
+		X float64 `ezpack:"x,strictfloat"`
+	}
+
+	type Norm struct {
+		X float64 `ezpack:"x,normfloat"`
+	}
+
+	// strictfloat should refuse to encode NaN, ±Inf and -0
+	for _, f := range []float64{math.NaN(), math.Inf(1), math.Inf(-1), math.Copysign(0, -1)} {
+		_, err := Encode(Strict{X: f})
+		require.Error(t, err)
+	}
+
+	// normfloat should fold -0 to +0
+	enc, err := Encode(Norm{X: math.Copysign(0, -1)})
+	require.NoError(t, err)
+
+	var norm Norm
+	err = DecodeBytes(enc, &norm)
+	require.NoError(t, err)
+	require.False(t, math.Signbit(norm.X))
+
+	// strictfloat and normfloat should reject -0 on the wire
+	enc, err = Encode(Plain{X: math.Copysign(0, -1)})
+	require.NoError(t, err)
+
+	var strict Strict
+	err = DecodeBytes(enc, &strict)
+	require.Error(t, err)
+
+	err = DecodeBytes(enc, &norm)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "non-canonical float")
+
+	// The options cannot be combined
+	type Both struct {
+		X float64 `ezpack:"x,strictfloat,normfloat"`
+	}
+
+	_, err = Encode(Both{})
+	require.Error(t, err)
+}
+
+func TestCanEncodeDecodePointers(t *testing.T) {
+	type Child struct {
+		Foo string `ezpack:"foo,5"`
+	}
+
+	type Struct struct {
+		Str   *string `ezpack:"str,5"`
+		Empty *string `ezpack:"empty,5"`
+		Nil   *string `ezpack:"nil,5"`
+		Num   *uint64 `ezpack:"num"`
+		Child *Child  `ezpack:"child"`
+		None  *Child  `ezpack:"none"`
+	}
+
+	str := "hello"
+	empty := ""
+	num := uint64(1234)
+	s := Struct{
+		Str:   &str,
+		Empty: &empty,
+		Num:   &num,
+		Child: &Child{Foo: "bar"},
+	}
+
+	enc, err := Encode(s)
+	require.NoError(t, err)
+
+	var res Struct
+	err = DecodeBytes(enc, &res)
+	require.NoError(t, err)
+
+	// An empty string and a nil string should be distinguishable
+	require.Equal(t, res, s)
+	require.NotNil(t, res.Empty)
+	require.Nil(t, res.Nil)
+	require.Nil(t, res.None)
+}
+
+func TestPointersToNilableTypesAreRejected(t *testing.T) {
+	type PtPt struct {
+		P **uint64 `ezpack:"p"`
+	}
+
+	type PtIface struct {
+		P *command `ezpack:"p,union"`
+	}
+
+	type PtSlice struct {
+		P []**uint64 `ezpack:"p,1"`
+	}
+
+	// A nil inner pointer would be encoded the same way as a nil outer one
+	var inner *uint64
+	_, err := Encode(PtPt{P: &inner})
+	require.EqualError(t, err, "error encoding 'p': cannot use **uint64: pointers to pointers or interfaces are not supported")
+
+	var cmd command
+	_, err = Encode(PtIface{P: &cmd})
+	require.EqualError(t, err, "error encoding 'p': cannot use *ezpack.command: pointers to pointers or interfaces are not supported")
+
+	_, err = Encode(PtSlice{P: []**uint64{nil}})
+	require.Error(t, err)
+
+	// Decoding is rejected even when the input is nil
+	enc, err := Encode(struct {
+		P *uint64 `ezpack:"p"`
+	}{})
+	require.NoError(t, err)
+
+	err = DecodeBytes(enc, &PtPt{})
+	require.EqualError(t, err, "error decoding 'p': cannot use **uint64: pointers to pointers or interfaces are not supported")
+
+	err = DecodeBytes(enc, &PtIface{})
+	require.Error(t, err)
+}
+
+func TestDecodingNilClearsPointer(t *testing.T) {
+	type Struct struct {
+		X *uint64 `ezpack:"x"`
+	}
+
+	enc, err := Encode(Struct{})
+	require.NoError(t, err)
+
+	num := uint64(1234)
+	res := Struct{X: &num}
+	err = DecodeBytes(enc, &res)
+	require.NoError(t, err)
+	require.Nil(t, res.X)
+}
+
+// listNode and treeNode are recursive through a pointer and a slice
+type listNode struct {
+	Next *listNode `ezpack:"next"`
+}
+
+type treeNode struct {
+	Children []treeNode `ezpack:"children,1"`
+}
+
+func TestCannotDecodeBeyondMaxDepth(t *testing.T) {
+	// Encoding has no depth limit, so we can use it to build deep inputs
+	list := &listNode{}
+	tree := treeNode{}
+	neg := &negExpr{}
+	for i := 0; i < maxDecodeDepth; i++ {
+		list = &listNode{Next: list}
+		tree = treeNode{Children: []treeNode{tree}}
+		neg = &negExpr{X: neg}
+	}
+
+	for _, v := range []interface{}{list, tree, neg} {
+		enc, err := Encode(v)
+		require.NoError(t, err)
+
+		res := reflect.New(reflect.Indirect(reflect.ValueOf(v)).Type())
+		err = DecodeBytes(enc, res.Interface())
+		require.True(t, errors.Is(err, ErrMaxDepth), "%T: %v", v, err)
+	}
+
+	// Reasonable depths are fine
+	list = &listNode{}
+	for i := 0; i < 100; i++ {
+		list = &listNode{Next: list}
+	}
+	enc, err := Encode(list)
+	require.NoError(t, err)
+
+	var res listNode
+	err = DecodeBytes(enc, &res)
+	require.NoError(t, err)
+	require.Equal(t, *list, res)
+}
+
+func TestCanEncodeDecodeMaps(t *testing.T) {
+	type Child struct {
+		Foo uint64 `ezpack:"foo"`
+	}
+
+	type Struct struct {
+		Labels   map[string]string `ezpack:"labels,3,keylen=5,elemlen=5"`
+		Counts   map[string]uint64 `ezpack:"counts,3,keylen=5"`
+		Children map[string]Child  `ezpack:"children,3,keylen=5"`
+		Empty    map[string]uint64 `ezpack:"empty,3,keylen=5"`
+	}
+
+	s := Struct{
+		Labels:   map[string]string{"zed": "a", "abc": "b", "mid": "c"},
+		Counts:   map[string]uint64{"x": 1, "y": 2},
+		Children: map[string]Child{"kid": Child{Foo: 3}},
+		Empty:    map[string]uint64{},
+	}
+
+	enc, err := Encode(s)
+	require.NoError(t, err)
+
+	// Encoding should not depend on map iteration order
+	for i := 0; i < 10; i++ {
+		again, err := Encode(s)
+		require.NoError(t, err)
+		require.Equal(t, enc, again)
+	}
+
+	var res Struct
+	err = DecodeBytes(enc, &res)
+	require.NoError(t, err)
+
+	require.Equal(t, res, s)
+}
+
+func TestCanEncodeDecodeNestedMaps(t *testing.T) {
+	type Struct struct {
+		Rows  []map[string]uint64 `ezpack:"rows,4,elemlen=4,keylen=8"`
+		Fixed [2]map[string]bool  `ezpack:"fixed,elemlen=1,keylen=3"`
+	}
+
+	s := Struct{
+		Rows: []map[string]uint64{
+			map[string]uint64{"a": 1},
+			map[string]uint64{"abcdefgh": 2, "b": 3},
+		},
+		Fixed: [2]map[string]bool{
+			map[string]bool{"yes": true},
+			map[string]bool{},
+		},
+	}
+
+	enc, err := Encode(s)
+	require.NoError(t, err)
+
+	var res Struct
+	err = DecodeBytes(enc, &res)
+	require.NoError(t, err)
+	require.Equal(t, s, res)
+
+	// The key length applies to the nested maps
+	s.Rows[0]["abcdefghi"] = 4
+	enc, err = Encode(s)
+	require.NoError(t, err)
+	err = DecodeBytes(enc, &res)
+	require.Error(t, err)
+
+	// So does the one given at the top level
+	rows := []map[string]uint64{map[string]uint64{"abc": 1}}
+	enc, err = EncodeValue(rows, Limits{})
+	require.NoError(t, err)
+
+	var resRows []map[string]uint64
+	err = DecodeValueBytes(enc, &resRows, Limits{MaxLen: 1, ElemMaxLen: 1, KeyMaxLen: 3})
+	require.NoError(t, err)
+	require.Equal(t, rows, resRows)
+}
+
+func TestCannotDecodeNonCanonicalMaps(t *testing.T) {
+	type Struct struct {
+		M map[string]uint64 `ezpack:"m,3,keylen=5"`
+	}
+
+	// Build a struct encoding whose map has the given keys, in order
+	encodeWithKeys := func(keys ...string) []byte {
+		var inner PackMap
+		for _, k := range keys {
+			inner.Elements = append(inner.Elements, PackMapElement{
+				Key:   PackString{String: k},
+				Value: PackUint64{Value: 1},
+			})
+		}
+		outer := PackMap{
+			Elements: []PackMapElement{
+				PackMapElement{Key: PackString{String: "m"}, Value: inner},
+			},
+		}
+		enc, err := outer.Encode()
+		require.NoError(t, err)
+		return enc
+	}
+
+	var res Struct
+	err := DecodeBytes(encodeWithKeys("a", "b", "c"), &res)
+	require.NoError(t, err)
+
+	// Unsorted keys
+	err = DecodeBytes(encodeWithKeys("b", "a"), &res)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not sorted")
+
+	// Duplicate keys
+	err = DecodeBytes(encodeWithKeys("a", "a"), &res)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "duplicate key")
+
+	// Too many entries
+	err = DecodeBytes(encodeWithKeys("a", "b", "c", "d"), &res)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "max is 3")
+
+	// Key too long
+	err = DecodeBytes(encodeWithKeys("abcdef"), &res)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "max is 5")
+}
+
+func TestCanEncodeDecodeScalarSlices(t *testing.T) {
+	type Struct struct {
+		Names []string  `ezpack:"names,3,elemlen=5"`
+		Nums  []int64   `ezpack:"nums,3"`
+		Blobs [][]byte  `ezpack:"blobs,3,elemlen=5"`
+		Opt   []*uint64 `ezpack:"opt,3"`
+		Empty []string  `ezpack:"empty,3,elemlen=5"`
+	}
+
+	num := uint64(1234)
+	s := Struct{
+		Names: []string{"hello", "", "abc"},
+		Nums:  []int64{-1, 0, 1},
+		Blobs: [][]byte{[]byte("bar")},
+		Opt:   []*uint64{&num, nil},
+		Empty: []string{},
+	}
+
+	enc, err := Encode(s)
+	require.NoError(t, err)
+
+	var res Struct
+	err = DecodeBytes(enc, &res)
+	require.NoError(t, err)
+
+	require.Equal(t, res, s)
+}
+
+func TestCannotDecodeSliceBeyondElemLen(t *testing.T) {
+	type Long struct {
+		Names []string `ezpack:"names,3,elemlen=5"`
+	}
+
+	type Short struct {
+		Names []string `ezpack:"names,3,elemlen=3"`
+	}
+
+	enc, err := Encode(Long{Names: []string{"abc", "hello"}})
+	require.NoError(t, err)
+
+	// Second element is too long
+	var short Short
+	err = DecodeBytes(enc, &short)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "max is 3")
+
+	// Too many elements
+	enc, err = Encode(Long{Names: []string{"a", "b", "c", "d"}})
+	require.NoError(t, err)
+
+	var long Long
+	err = DecodeBytes(enc, &long)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "max is 3")
+}
+
+func TestCanEncodeDecodeNonByteArrays(t *testing.T) {
+	type Child struct {
+		Foo string `ezpack:"foo,5"`
+	}
+
+	type Struct struct {
+		Nums     [4]uint64 `ezpack:"nums"`
+		Names    [2]string `ezpack:"names,elemlen=5"`
+		Children [3]Child  `ezpack:"children"`
+	}
+
+	s := Struct{
+		Nums:     [4]uint64{1, 2, 3, 4},
+		Names:    [2]string{"hello", "abc"},
+		Children: [3]Child{Child{Foo: "x"}, Child{Foo: "y"}, Child{Foo: "z"}},
+	}
+
+	enc, err := Encode(s)
+	require.NoError(t, err)
+
+	var res Struct
+	err = DecodeBytes(enc, &res)
+	require.NoError(t, err)
+
+	require.Equal(t, res, s)
+}
+
+func TestNonByteArrayDecodingLengthIsExact(t *testing.T) {
+	type Struct struct {
+		Nums [4]uint64 `ezpack:"nums"`
+	}
+
+	type Shorter struct {
+		Nums [3]uint64 `ezpack:"nums"`
+	}
+
+	type Longer struct {
+		Nums [5]uint64 `ezpack:"nums"`
+	}
+
+	enc, err := Encode(Struct{})
+	require.NoError(t, err)
+
+	var shorter Shorter
+	err = DecodeBytes(enc, &shorter)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "expected array of length 3")
+
+	var longer Longer
+	err = DecodeBytes(enc, &longer)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "expected array of length 5")
+}
+
+func TestByteArraysDoNotNeedMaxLen(t *testing.T) {
+	type Struct struct {
+		Hash [32]byte `ezpack:"hash"`
+		Pair [2]uint8 `ezpack:"pair"`
+	}
+
+	s := Struct{
+		Hash: [32]byte{0x01, 0x02, 31: 0xFF},
+		Pair: [2]uint8{0x77, 0x88},
+	}
+
+	enc, err := Encode(s)
+	require.NoError(t, err)
+
+	var res Struct
+	err = DecodeBytes(enc, &res)
+	require.NoError(t, err)
+
+	require.Equal(t, res, s)
+}
+
+func TestByteArrayLengthCheckedBeforeReading(t *testing.T) {
+	type Struct struct {
+		Hash [4]byte `ezpack:"hash"`
+	}
+
+	// A header claiming a huge length should be rejected without needing the
+	// data to be present
+	enc, err := PackMap{
+		Elements: []PackMapElement{
+			PackMapElement{Key: PackString{String: "hash"}, Value: PackBytes{}},
+		},
+	}.Encode()
+	require.NoError(t, err)
+	binary.BigEndian.PutUint32(enc[len(enc)-4:], math.MaxUint32)
+
+	var res Struct
+	err = DecodeBytes(enc, &res)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "expected array of length 4")
+}
+
+func TestCanEncodeDecodeInlineStructs(t *testing.T) {
+	type Audit struct {
+		Author string `ezpack:"author,5"`
+	}
+
+	type Header struct {
+		Audit `ezpack:",inline"`
+		ID    uint64 `ezpack:"id"`
+	}
+
+	type Request struct {
+		Header `ezpack:",inline"`
+		Body   string `ezpack:"body,5"`
+	}
+
+	type Flat struct {
+		Body   string `ezpack:"body,5"`
+		ID     uint64 `ezpack:"id"`
+		Author string `ezpack:"author,5"`
+	}
+
+	r := Request{
+		Header: Header{
+			Audit: Audit{Author: "bob"},
+			ID:    1234,
+		},
+		Body: "hello",
+	}
+
+	enc, err := Encode(r)
+	require.NoError(t, err)
+
+	// Inline fields should encode exactly as if declared in the parent
+	flat, err := Encode(Flat{Body: "hello", ID: 1234, Author: "bob"})
+	require.NoError(t, err)
+	require.Equal(t, enc, flat)
+
+	var res Request
+	err = DecodeBytes(enc, &res)
+	require.NoError(t, err)
+
+	require.Equal(t, res, r)
+}
+
+func TestSkippedFieldsAreIgnored(t *testing.T) {
+	type Struct struct {
+		Foo   uint64     `ezpack:"foo"`
+		Cache string     `ezpack:"-"`
+		mu    sync.Mutex `ezpack:"-"`
+	}
+
+	type Plain struct {
+		Foo uint64 `ezpack:"foo"`
+	}
+
+	enc, err := Encode(&Struct{Foo: 1234, Cache: "derived"})
+	require.NoError(t, err)
+
+	// Skipped fields should not appear on the wire
+	plain, err := Encode(Plain{Foo: 1234})
+	require.NoError(t, err)
+	require.Equal(t, enc, plain)
+
+	// Skipped fields should be left alone when decoding
+	res := Struct{Cache: "kept"}
+	err = DecodeBytes(enc, &res)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1234), res.Foo)
+	require.Equal(t, "kept", res.Cache)
+}
+
+func TestCannotDecodeUnexportedFields(t *testing.T) {
+	type Struct struct {
+		Foo uint64 `ezpack:"foo"`
+		bar uint64 `ezpack:"bar"`
+	}
+
+	type Wire struct {
+		Foo uint64 `ezpack:"foo"`
+		Bar uint64 `ezpack:"bar"`
+	}
+
+	enc, err := Encode(Wire{Foo: 1, Bar: 2})
+	require.NoError(t, err)
+
+	// The schema error should be reported before anything is read
+	buf := bytes.NewBuffer(enc)
+	var res Struct
+	err = Decode(buf, &res)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unexported field 'bar'")
+	require.Equal(t, len(enc), buf.Len())
+}
+
+func TestCanEncodeDecodeEmptyStructs(t *testing.T) {
+	type Ack struct{}
+
+	type Parent struct {
+		Acks []Ack `ezpack:"acks,3"`
+		Ack  Ack   `ezpack:"ack"`
+	}
+
+	p := Parent{
+		Acks: []Ack{Ack{}, Ack{}},
+	}
+
+	enc, err := Encode(p)
+	require.NoError(t, err)
+
+	var res Parent
+	err = DecodeBytes(enc, &res)
+	require.NoError(t, err)
+
+	require.Equal(t, res, p)
+
+	// Struct slices of empty structs should still honour their max length
+	enc, err = Encode(Parent{Acks: make([]Ack, 4)})
+	require.NoError(t, err)
+
+	err = DecodeBytes(enc, &res)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "max is 3")
+}
+
+func TestCannotDecodeNonEmptyMapIntoEmptyStruct(t *testing.T) {
+	type Ping struct{}
+
+	type Other struct {
+		Foo uint64 `ezpack:"foo"`
+	}
+
+	enc, err := Encode(Other{Foo: 1})
+	require.NoError(t, err)
+
+	var res Ping
+	err = DecodeBytes(enc, &res)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "wrong map size")
+}
+
+// money is carried as a number of cents on the wire
+type money struct {
+	Dollars uint64
+	Cents   uint64
+}
+
+func (m money) MarshalEzpack() (PackValue, error) {
+	return PackUint64{Value: m.Dollars*100 + m.Cents}, nil
+}
+
+func (m *money) UnmarshalEzpack(pv PackValue) error {
+	cents, ok := pv.(PackUint64)
+	if !ok {
+		return fmt.Errorf("money must be a uint64, not %T", pv)
+	}
+	m.Dollars, m.Cents = cents.Value/100, cents.Value%100
+	return nil
+}
+
+// version is carried as a "major.minor" string on the wire
+type version struct {
+	Major uint64
+	Minor uint64
+}
+
+func (v version) MarshalEzpack() (PackValue, error) {
+	return PackString{String: fmt.Sprintf("%d.%d", v.Major, v.Minor)}, nil
+}
+
+func (v *version) UnmarshalEzpack(pv PackValue) error {
+	s, ok := pv.(PackString)
+	if !ok {
+		return fmt.Errorf("version must be a string, not %T", pv)
+	}
+	_, err := fmt.Sscanf(s.String, "%d.%d", &v.Major, &v.Minor)
+	return err
+}
+
+func TestCanEncodeDecodeCustomMarshalers(t *testing.T) {
+	type Struct struct {
+		Price    money            `ezpack:"price"`
+		Version  version          `ezpack:"version,8"`
+		Versions []version        `ezpack:"versions,2,elemlen=8"`
+		Opt      *money           `ezpack:"opt"`
+		Prices   map[string]money `ezpack:"prices,2,keylen=5"`
+	}
+
+	s := Struct{
+		Price:    money{Dollars: 12, Cents: 34},
+		Version:  version{Major: 1, Minor: 2},
+		Versions: []version{version{Major: 3, Minor: 4}},
+		Prices:   map[string]money{"a": money{Dollars: 1}},
+	}
+
+	enc, err := Encode(s)
+	require.NoError(t, err)
+
+	// The custom types should be carried as their PackValues
+	type Wire struct {
+		Price    uint64            `ezpack:"price"`
+		Version  string            `ezpack:"version,8"`
+		Versions []string          `ezpack:"versions,2,elemlen=8"`
+		Opt      *uint64           `ezpack:"opt"`
+		Prices   map[string]uint64 `ezpack:"prices,2,keylen=5"`
+	}
+
+	wire, err := Encode(Wire{
+		Price:    1234,
+		Version:  "1.2",
+		Versions: []string{"3.4"},
+		Prices:   map[string]uint64{"a": 100},
+	})
+	require.NoError(t, err)
+	require.Equal(t, wire, enc)
+
+	var res Struct
+	err = DecodeBytes(enc, &res)
+	require.NoError(t, err)
+
+	require.Equal(t, res, s)
+}
+
+func TestCustomUnmarshalersAreLimited(t *testing.T) {
+	type Struct struct {
+		Version version `ezpack:"version,3"`
+	}
+
+	enc, err := Encode(Struct{Version: version{Major: 100, Minor: 200}})
+	require.NoError(t, err)
+
+	// The tag's max length should be enforced before UnmarshalEzpack is called
+	var res Struct
+	err = DecodeBytes(enc, &res)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "max is 3")
+}
+
+func TestCannotDecodeNonCanonicalCustomMarshalers(t *testing.T) {
+	type Struct struct {
+		Version version `ezpack:"version,8"`
+	}
+
+	type Wire struct {
+		Version string `ezpack:"version,8"`
+	}
+
+	// UnmarshalEzpack accepts "01.002", but it would marshal as "1.2"
+	enc, err := Encode(Wire{Version: "01.002"})
+	require.NoError(t, err)
+
+	var res Struct
+	err = DecodeBytes(enc, &res)
+	require.EqualError(t, err, "error decoding 'version': got non-canonical encoding of ezpack.version")
+
+	enc, err = Encode(Wire{Version: "1.2"})
+	require.NoError(t, err)
+
+	err = DecodeBytes(enc, &res)
+	require.NoError(t, err)
+	require.Equal(t, version{Major: 1, Minor: 2}, res.Version)
+}
+
+func TestCanEncodeDecodeStdMarshalers(t *testing.T) {
+	type Struct struct {
+		Addr    net.IP     `ezpack:"addr,39,text"`
+		Addrs   []net.IP   `ezpack:"addrs,2,elemlen=39,text"`
+		Balance *big.Int   `ezpack:"balance,64,text"`
+		None    *big.Int   `ezpack:"none,64,text"`
+		Link    url.URL    `ezpack:"link,64,binary"`
+		Ratio   *big.Float `ezpack:"ratio,64,text"`
+	}
+
+	balance, ok := new(big.Int).SetString("-123456789012345678901234567890", 10)
+	require.True(t, ok)
+
+	s := Struct{
+		Addr:    net.ParseIP("2001:db8::1"),
+		Addrs:   []net.IP{net.ParseIP("10.0.0.1")},
+		Balance: balance,
+		Link:    url.URL{Scheme: "https", Host: "example.com", Path: "/x"},
+		Ratio:   big.NewFloat(1.5),
+	}
+
+	enc, err := Encode(s)
+	require.NoError(t, err)
+
+	// Fields should be carried as their text or binary forms
+	type Wire struct {
+		Addr    string   `ezpack:"addr,39"`
+		Addrs   []string `ezpack:"addrs,2,elemlen=39"`
+		Balance *string  `ezpack:"balance,64"`
+		None    *string  `ezpack:"none,64"`
+		Link    []byte   `ezpack:"link,64"`
+		Ratio   *string  `ezpack:"ratio,64"`
+	}
+
+	var wire Wire
+	err = DecodeBytes(enc, &wire)
+	require.NoError(t, err)
+	require.Equal(t, "2001:db8::1", wire.Addr)
+	require.Equal(t, []string{"10.0.0.1"}, wire.Addrs)
+	require.Equal(t, "-123456789012345678901234567890", *wire.Balance)
+	require.Nil(t, wire.None)
+	require.Equal(t, []byte("https://example.com/x"), wire.Link)
+
+	var res Struct
+	err = DecodeBytes(enc, &res)
+	require.NoError(t, err)
+
+	require.Equal(t, res.Addr, s.Addr)
+	require.Equal(t, res.Addrs, s.Addrs)
+	require.Equal(t, 0, res.Balance.Cmp(s.Balance))
+	require.Nil(t, res.None)
+	require.Equal(t, res.Link, s.Link)
+	require.Equal(t, 0, res.Ratio.Cmp(s.Ratio))
+}
+
+func TestCannotDecodeNonCanonicalOrLongStdMarshalers(t *testing.T) {
+	type Struct struct {
+		Balance big.Int `ezpack:"balance,5,text"`
+	}
+
+	type Wire struct {
+		Balance string `ezpack:"balance,10"`
+	}
+
+	// Leading zeros are accepted by UnmarshalText but are not canonical
+	enc, err := Encode(Wire{Balance: "007"})
+	require.NoError(t, err)
+
+	var res Struct
+	err = DecodeBytes(enc, &res)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "non-canonical")
+
+	// The max length should be enforced before unmarshaling
+	enc, err = Encode(Wire{Balance: "1234567"})
+	require.NoError(t, err)
+
+	err = DecodeBytes(enc, &res)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "max is 5")
+}
+
+func TestCanEncodeDecodeTimes(t *testing.T) {
+	type Struct struct {
+		At     time.Time   `ezpack:"at"`
+		Zero   time.Time   `ezpack:"zero"`
+		Before time.Time   `ezpack:"before"`
+		Opt    *time.Time  `ezpack:"opt"`
+		Times  []time.Time `ezpack:"times,2"`
+	}
+
+	at := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	s := Struct{
+		At:     at,
+		Before: time.Date(1900, 1, 1, 0, 0, 0, 999999999, time.UTC),
+		Opt:    &at,
+		Times:  []time.Time{at},
+	}
+
+	enc, err := Encode(s)
+	require.NoError(t, err)
+
+	var res Struct
+	err = DecodeBytes(enc, &res)
+	require.NoError(t, err)
+
+	require.True(t, res.At.Equal(s.At))
+	require.True(t, res.Zero.Equal(s.Zero))
+	require.True(t, res.Before.Equal(s.Before))
+	require.True(t, res.Opt.Equal(*s.Opt))
+	require.True(t, res.Times[0].Equal(s.Times[0]))
+	require.Equal(t, time.UTC, res.At.Location())
+}
+
+func TestCannotDecodeNonCanonicalTimes(t *testing.T) {
+	type Struct struct {
+		At time.Time `ezpack:"at"`
+	}
+
+	enc, err := Encode(Struct{})
+	require.NoError(t, err)
+	ts := enc[len(enc)-15:]
+
+	// Nanoseconds out of range
+	bad := append([]byte{}, enc...)
+	binary.BigEndian.PutUint32(bad[len(bad)-12:], 1e9)
+
+	var res Struct
+	err = DecodeBytes(bad, &res)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "out of range")
+
+	// 64-bit timestamp format
+	bad = append([]byte{}, enc[:len(enc)-15]...)
+	bad = append(bad, PackExt8ID, 8, ts[2], 0, 0, 0, 0, 0, 0, 0, 0)
+	err = DecodeBytes(bad, &res)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "length 8")
+
+	// Wrong extension type
+	bad = append([]byte{}, enc...)
+	bad[len(bad)-13] = 0x01
+	err = DecodeBytes(bad, &res)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "extension type")
+}
+
+// uuid is registered as an extension of type uuidExtType
+type uuid [16]byte
+
+const uuidExtType = 1
+
+func init() {
+	err := RegisterExt(uuidExtType, reflect.TypeOf(uuid{}), 16,
+		func(v interface{}) ([]byte, error) {
+			u := v.(uuid)
+			return u[:], nil
+		},
+		func(data []byte) (interface{}, error) {
+			var u uuid
+			if len(data) != len(u) {
+				return nil, fmt.Errorf("uuid must be %d bytes", len(u))
+			}
+			copy(u[:], data)
+			return u, nil
+		},
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestCanEncodeDecodeExtensions(t *testing.T) {
+	type Struct struct {
+		ID    uuid            `ezpack:"id"`
+		Opt   *uuid           `ezpack:"opt"`
+		IDs   []uuid          `ezpack:"ids,2"`
+		ByKey map[string]uuid `ezpack:"bykey,2,keylen=5"`
+	}
+
+	id := uuid{0x01, 15: 0xFF}
+	s := Struct{
+		ID:    id,
+		Opt:   &id,
+		IDs:   []uuid{id, uuid{}},
+		ByKey: map[string]uuid{"a": id},
+	}
+
+	enc, err := Encode(s)
+	require.NoError(t, err)
+
+	var res Struct
+	err = DecodeBytes(enc, &res)
+	require.NoError(t, err)
+
+	require.Equal(t, res, s)
+
+	// The extension should be encoded as ext32
+	enc, err = Encode(struct {
+		ID uuid `ezpack:"id"`
+	}{ID: id})
+	require.NoError(t, err)
+	ext := enc[len(enc)-22:]
+	require.Equal(t, []byte{PackExt32ID, 0, 0, 0, 16, uuidExtType}, ext[:6])
+	require.Equal(t, id[:], ext[6:])
+}
+
+func TestCannotDecodeBadExtensions(t *testing.T) {
+	type Struct struct {
+		ID uuid `ezpack:"id"`
+	}
+
+	encodeExt := func(pe PackExt) []byte {
+		enc, err := PackMap{
+			Elements: []PackMapElement{
+				PackMapElement{Key: PackString{String: "id"}, Value: pe},
+			},
+		}.Encode()
+		require.NoError(t, err)
+		return enc
+	}
+
+	// Longer than the registered max length
+	var res Struct
+	err := DecodeBytes(encodeExt(PackExt{Type: uuidExtType, Data: make([]byte, 17)}), &res)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "max is 16")
+
+	// Wrong type code
+	err = DecodeBytes(encodeExt(PackExt{Type: uuidExtType + 1, Data: make([]byte, 16)}), &res)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "extension type")
+
+	// Rejected by the decoder
+	err = DecodeBytes(encodeExt(PackExt{Type: uuidExtType, Data: make([]byte, 15)}), &res)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "uuid must be")
+}
+
+// command is registered as a union with a value variant and a pointer variant
+type command interface {
+	isCommand()
+}
+
+type moveCommand struct {
+	X int64 `ezpack:"x"`
+	Y int64 `ezpack:"y"`
+}
+
+func (moveCommand) isCommand() {}
+
+type sayCommand struct {
+	Text string `ezpack:"text,5"`
+}
+
+func (*sayCommand) isCommand() {}
+
+func init() {
+	err := RegisterUnion(reflect.TypeOf((*command)(nil)).Elem(), map[string]reflect.Type{
+		"move": reflect.TypeOf(moveCommand{}),
+		"say":  reflect.TypeOf(&sayCommand{}),
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// expr is a union with a recursive variant
+type expr interface {
+	isExpr()
+}
+
+type negExpr struct {
+	X expr `ezpack:"x,union"`
+}
+
+func (*negExpr) isExpr() {}
+
+func init() {
+	err := RegisterUnion(reflect.TypeOf((*expr)(nil)).Elem(), map[string]reflect.Type{
+		"neg": reflect.TypeOf(&negExpr{}),
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestCanEncodeDecodeUnions(t *testing.T) {
+	type Struct struct {
+		Move command   `ezpack:"move,union"`
+		Say  command   `ezpack:"say,union"`
+		None command   `ezpack:"none,union"`
+		All  []command `ezpack:"all,3,union"`
+	}
+
+	s := Struct{
+		Move: moveCommand{X: 1, Y: -1},
+		Say:  &sayCommand{Text: "hi"},
+		All:  []command{moveCommand{}, &sayCommand{Text: "bye"}},
+	}
+
+	enc, err := Encode(s)
+	require.NoError(t, err)
+
+	var res Struct
+	err = DecodeBytes(enc, &res)
+	require.NoError(t, err)
+
+	require.Equal(t, res, s)
+
+	// A union should be encoded as [name, map]
+	enc, err = Encode(struct {
+		Move command `ezpack:"move,union"`
+	}{Move: moveCommand{X: 1}})
+	require.NoError(t, err)
+
+	inner, err := Encode(moveCommand{X: 1})
+	require.NoError(t, err)
+	name, err := PackString{String: "move"}.Encode()
+	require.NoError(t, err)
+	require.Equal(t, append(append([]byte{PackArrayID, 0, 0, 0, 2}, name...), inner...), enc[len(enc)-5-len(name)-len(inner):])
+}
+
+func TestCannotDecodeUnknownVariant(t *testing.T) {
+	type Struct struct {
+		Cmd command `ezpack:"cmd,union"`
+	}
+
+	enc, err := PackMap{
+		Elements: []PackMapElement{
+			PackMapElement{
+				Key: PackString{String: "cmd"},
+				Value: PackValueSlice{
+					Values: []PackValue{PackString{String: "jump"}, PackMap{}},
+				},
+			},
+		},
+	}.Encode()
+	require.NoError(t, err)
+
+	var res Struct
+	err = Decode(bytes.NewReader(enc), &res)
+	require.Error(t, err)
+
+	// The error should be typed, even when wrapped in field context
+	var uve *UnknownVariantError
+	require.True(t, errors.As(err, &uve))
+	require.Equal(t, "jump", uve.Name)
+}
+
+func TestCanEncodeDecodeBigInts(t *testing.T) {
+	type Struct struct {
+		Pos  *big.Int  `ezpack:"pos,32"`
+		Neg  big.Int   `ezpack:"neg,32"`
+		Zero *big.Int  `ezpack:"zero,32"`
+		None *big.Int  `ezpack:"none,32"`
+		Many []big.Int `ezpack:"many,2,elemlen=32"`
+	}
+
+	pos, ok := new(big.Int).SetString("123456789012345678901234567890", 10)
+	require.True(t, ok)
+
+	s := Struct{
+		Pos:  pos,
+		Neg:  *big.NewInt(-256),
+		Zero: new(big.Int).Neg(big.NewInt(0)),
+		Many: []big.Int{*big.NewInt(1)},
+	}
+
+	enc, err := Encode(s)
+	require.NoError(t, err)
+
+	var res Struct
+	err = DecodeBytes(enc, &res)
+	require.NoError(t, err)
+
+	require.Equal(t, 0, res.Pos.Cmp(s.Pos))
+	require.Equal(t, 0, res.Neg.Cmp(&s.Neg))
+	require.Equal(t, 0, res.Zero.Sign())
+	require.Nil(t, res.None)
+	require.Equal(t, 0, res.Many[0].Cmp(&s.Many[0]))
+
+	// -256 should be a negative sign byte followed by a minimal magnitude
+	var wire struct {
+		Neg []byte `ezpack:"neg,32"`
+	}
+	enc, err = Encode(struct {
+		Neg big.Int `ezpack:"neg"`
+	}{Neg: *big.NewInt(-256)})
+	require.NoError(t, err)
+	err = DecodeBytes(enc, &wire)
+	require.NoError(t, err)
+	require.Equal(t, []byte{BigIntNegative, 0x01, 0x00}, wire.Neg)
+}
+
+func TestCannotDecodeNonCanonicalBigInts(t *testing.T) {
+	type Struct struct {
+		X big.Int `ezpack:"x,2"`
+	}
+
+	type Wire struct {
+		X []byte `ezpack:"x,8"`
+	}
+
+	for _, bad := range [][]byte{
+		{},                                    // no sign byte
+		{0x02, 0x01},                          // invalid sign
+		{BigIntNonNegative, 0x00, 0x01},       // leading zero
+		{BigIntNegative},                      // negative zero
+		{BigIntNonNegative, 0x01, 0x02, 0x03}, // magnitude too long
+	} {
+		enc, err := Encode(Wire{X: bad})
+		require.NoError(t, err)
+
+		var res Struct
+		err = DecodeBytes(enc, &res)
+		require.Error(t, err, "%x", bad)
+	}
+}
+
+func TestCanEncodeDecodeTopLevelValues(t *testing.T) {
+	type Record struct {
+		Foo string `ezpack:"foo,5"`
+	}
+
+	records := []Record{Record{Foo: "a"}, Record{Foo: "b"}}
+	enc, err := EncodeValue(records, Limits{})
+	require.NoError(t, err)
+
+	var res []Record
+	err = DecodeValueBytes(enc, &res, Limits{MaxLen: 2})
+	require.NoError(t, err)
+	require.Equal(t, records, res)
+
+	// Limits should be enforced
+	err = DecodeValueBytes(enc, &res, Limits{MaxLen: 1})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "max is 1")
+
+	names := map[string]string{"abc": "hello"}
+	enc, err = EncodeValue(&names, Limits{})
+	require.NoError(t, err)
+
+	var resNames map[string]string
+	err = DecodeValueBytes(enc, &resNames, Limits{MaxLen: 1, KeyMaxLen: 3, ElemMaxLen: 5})
+	require.NoError(t, err)
+	require.Equal(t, names, resNames)
+
+	// A pointer is needed to decode into
+	var s string
+	err = DecodeValueBytes(enc, s, Limits{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "non-nil pointer")
+}
+
+func TestCanEncodeDecodeTopLevelOptions(t *testing.T) {
+	// An interface value must be passed by pointer, or it is just its variant
+	var cmd command = &sayCommand{Text: "hi"}
+	enc, err := EncodeValue(&cmd, Limits{Union: true})
+	require.NoError(t, err)
+
+	// It should be encoded the same way as a union field
+	fieldEnc, err := Encode(struct {
+		Cmd command `ezpack:"cmd,union"`
+	}{Cmd: cmd})
+	require.NoError(t, err)
+	require.Equal(t, enc, fieldEnc[len(fieldEnc)-len(enc):])
+
+	var resCmd command
+	err = DecodeValueBytes(enc, &resCmd, Limits{Union: true})
+	require.NoError(t, err)
+	require.Equal(t, cmd, resCmd)
+
+	// Without the option, interfaces aren't supported
+	_, err = EncodeValue(&cmd, Limits{})
+	require.EqualError(t, err, "interface fields require the union option")
+
+	// There has to be a value to encode
+	_, err = EncodeValue((*string)(nil), Limits{})
+	require.EqualError(t, err, "EncodeValue requires non-nil value")
+
+	_, err = EncodeValue(nil, Limits{})
+	require.EqualError(t, err, "EncodeValue requires non-nil value")
+
+	// Float options apply too
+	_, err = EncodeValue(math.Inf(1), Limits{StrictFloat: true})
+	require.Error(t, err)
+
+	enc, err = EncodeValue(math.Copysign(0, -1), Limits{NormFloat: true})
+	require.NoError(t, err)
+	require.Equal(t, []byte{PackFloat64ID, 0, 0, 0, 0, 0, 0, 0, 0}, enc)
+
+	// As do binary and text
+	ip := net.ParseIP("10.0.0.1")
+	enc, err = EncodeValue(ip, Limits{Text: true})
+	require.NoError(t, err)
+
+	var resIP net.IP
+	err = DecodeValueBytes(enc, &resIP, Limits{MaxLen: 16, Text: true})
+	require.NoError(t, err)
+	require.True(t, ip.Equal(resIP))
+
+	// Conflicting options are rejected
+	_, err = EncodeValue(1.0, Limits{StrictFloat: true, NormFloat: true})
+	require.EqualError(t, err, "cannot use both StrictFloat and NormFloat")
+
+	err = DecodeValueBytes(enc, &resIP, Limits{Binary: true, Text: true})
+	require.EqualError(t, err, "cannot use both Binary and Text")
+}
+
+func TestCannotDecodeTrailingBytes(t *testing.T) {
+	type Struct struct {
+		Foo uint64 `ezpack:"foo"`
+	}
+
+	enc, err := Encode(Struct{Foo: 1})
+	require.NoError(t, err)
+
+	var res Struct
+	err = DecodeBytes(append(enc, 0x00), &res)
+	require.Equal(t, ErrTrailingBytes, err)
+
+	encValue, err := EncodeValue("hello", Limits{})
+	require.NoError(t, err)
+
+	var s string
+	err = DecodeValueBytes(append(encValue, 0x00), &s, Limits{MaxLen: 5})
+	require.Equal(t, ErrTrailingBytes, err)
+}
+
+func TestCanDecodeBytesPrefix(t *testing.T) {
+	type Struct struct {
+		Foo uint64 `ezpack:"foo"`
+	}
+
+	enc1, err := Encode(Struct{Foo: 1})
+	require.NoError(t, err)
+
+	enc2, err := Encode(Struct{Foo: 2})
+	require.NoError(t, err)
+
+	// Decode two concatenated messages
+	data := append(append([]byte{}, enc1...), enc2...)
+
+	var res Struct
+	n, err := DecodeBytesPrefix(data, &res)
+	require.NoError(t, err)
+	require.Equal(t, len(enc1), n)
+	require.Equal(t, uint64(1), res.Foo)
+
+	n, err = DecodeBytesPrefix(data[n:], &res)
+	require.NoError(t, err)
+	require.Equal(t, len(enc2), n)
+	require.Equal(t, uint64(2), res.Foo)
+}
+
+func TestDecoderReadsSequence(t *testing.T) {
+	type Struct struct {
+		Foo uint64 `ezpack:"foo"`
+	}
+
+	var stream []byte
+	for i := uint64(0); i < 3; i++ {
+		enc, err := Encode(Struct{Foo: i})
+		require.NoError(t, err)
+		stream = append(stream, enc...)
+	}
+
+	dec := NewDecoder(bytes.NewReader(stream), DecoderOptions{})
+	for i := uint64(0); i < 3; i++ {
+		var res Struct
+		err := dec.Decode(&res)
+		require.NoError(t, err)
+		require.Equal(t, i, res.Foo)
+		require.Equal(t, int64(len(stream))*int64(i+1)/3, dec.InputOffset())
+	}
+
+	// A clean end of stream should be io.EOF
+	var res Struct
+	err := dec.Decode(&res)
+	require.Equal(t, io.EOF, err)
+}
+
+func TestDecoderReportsTruncation(t *testing.T) {
+	type Struct struct {
+		Foo uint64 `ezpack:"foo"`
+	}
+
+	enc, err := Encode(Struct{Foo: 1})
+	require.NoError(t, err)
+
+	// Cut the second message off part way through
+	stream := append(append([]byte{}, enc...), enc[:len(enc)-1]...)
+	dec := NewDecoder(bytes.NewReader(stream), DecoderOptions{})
+
+	var res Struct
+	err = dec.Decode(&res)
+	require.NoError(t, err)
+
+	err = dec.Decode(&res)
+	require.Equal(t, ErrTruncated, err)
+
+	// Errors are sticky, since we no longer know where we are in the stream
+	err = dec.Decode(&res)
+	require.Equal(t, ErrTruncated, err)
+}
+
+// failingReader returns its data, then err
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	if len(fr.data) == 0 {
+		return 0, fr.err
+	}
+	n := copy(p, fr.data)
+	fr.data = fr.data[n:]
+	return n, nil
+}
+
+func TestDecoderPassesThroughReadErrors(t *testing.T) {
+	type Struct struct {
+		Foo uint64 `ezpack:"foo"`
+	}
+
+	enc, err := Encode(Struct{Foo: 1})
+	require.NoError(t, err)
+
+	readErr := errors.New("connection reset")
+	dec := NewDecoder(&failingReader{data: enc[:3], err: readErr}, DecoderOptions{})
+
+	var res Struct
+	err = dec.Decode(&res)
+	require.Equal(t, readErr, err)
+}
+
+func TestDecoderRecoversFromSchemaErrors(t *testing.T) {
+	type Struct struct {
+		Foo uint64 `ezpack:"foo"`
+	}
+
+	type BadTag struct {
+		Foo uint64 `ezpack:"foo,bad"`
+	}
+
+	enc, err := Encode(Struct{Foo: 1})
+	require.NoError(t, err)
+	dec := NewDecoder(bytes.NewReader(enc), DecoderOptions{})
+
+	// Nothing is read before the schema errors are found, so the stream is
+	// still usable
+	err = dec.Decode(&BadTag{})
+	require.Error(t, err)
+
+	var s string
+	err = dec.Decode(&s)
+	require.EqualError(t, err, "Decode requires struct, not string")
+	require.Equal(t, int64(0), dec.InputOffset())
+
+	var res Struct
+	err = dec.Decode(&res)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Foo)
+}
+
+func TestDecoderEnforcesMaxMessageLen(t *testing.T) {
+	type Struct struct {
+		Foo string `ezpack:"foo,100"`
+	}
+
+	short, err := Encode(Struct{Foo: "a"})
+	require.NoError(t, err)
+
+	long, err := Encode(Struct{Foo: "hello world"})
+	require.NoError(t, err)
+
+	stream := append(append([]byte{}, short...), long...)
+	dec := NewDecoder(bytes.NewReader(stream), DecoderOptions{MaxMessageLen: int64(len(short))})
+
+	// The limit applies to each message separately
+	var res Struct
+	err = dec.Decode(&res)
+	require.NoError(t, err)
+
+	err = dec.Decode(&res)
+	require.Equal(t, ErrMessageTooLong, err)
+	require.Equal(t, int64(2*len(short)), dec.InputOffset())
+}
+
+// generatedPoint has hand-written versions of the methods ezpackgen generates
+type generatedPoint struct {
+	Next *generatedPoint `ezpack:"next"`
+	X    int8            `ezpack:"x"`
+}
+
+// generatedPointCalls counts calls to generatedPoint's methods
+var generatedPointCalls int
+
+func (p generatedPoint) EncodeEzpack(es genhooks.EncodeState) (*PackMap, error) {
+	generatedPointCalls++
+
+	next, err := genhooks.EncodeField(es, &p.Next, `ezpack:"next"`)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding '%s': %w", "next", err)
+	}
+
+	return &PackMap{Elements: []PackMapElement{
+		PackMapElement{Key: PackString{String: "next"}, Value: next.(PackValue)},
+		PackMapElement{Key: PackString{String: "x"}, Value: PackInt64{Value: int64(p.X)}},
+	}}, nil
+}
+
+func (p *generatedPoint) DecodeEzpack(ds genhooks.DecodeState, r io.Reader) error {
+	generatedPointCalls++
+
+	err := genhooks.ReadStructHeader(r, "generatedPoint", 2)
+	if err != nil {
+		return err
+	}
+
+	err = genhooks.ReadFieldName(r, "next")
+	if err != nil {
+		return err
+	}
+	err = genhooks.DecodeField(ds, r, &p.Next, `ezpack:"next"`)
+	if err != nil {
+		return fmt.Errorf("error decoding '%s': %w", "next", err)
+	}
+
+	err = genhooks.ReadFieldName(r, "x")
+	if err != nil {
+		return err
+	}
+	x, err := genhooks.ReadInt(r, reflect.Int8)
+	if err != nil {
+		return fmt.Errorf("error decoding '%s': %w", "x", err)
+	}
+	p.X = int8(x)
+
+	return nil
+}
+
+// withReflection runs f with generated code disabled, like
+// genhelp.WithReflection
+func withReflection(f func()) {
+	atomic.AddInt32(&genhooks.Disabled, 1)
+	defer atomic.AddInt32(&genhooks.Disabled, -1)
+
+	f()
+}
+
+func TestGeneratedCodeIsUsed(t *testing.T) {
+	type Outer struct {
+		P generatedPoint `ezpack:"p"`
+	}
+
+	s := Outer{P: generatedPoint{X: -5, Next: &generatedPoint{X: 7}}}
+
+	generatedPointCalls = 0
+	enc, err := Encode(s)
+	require.NoError(t, err)
+	require.Equal(t, 2, generatedPointCalls)
+
+	var res Outer
+	err = DecodeBytes(enc, &res)
+	require.NoError(t, err)
+	require.Equal(t, s, res)
+	require.Equal(t, 4, generatedPointCalls)
+
+	// The result should be the same as with reflection, which shouldn't call
+	// the generated methods at all
+	withReflection(func() {
+		ref, err := Encode(s)
+		require.NoError(t, err)
+		require.Equal(t, ref, enc)
+
+		var refRes Outer
+		err = DecodeBytes(enc, &refRes)
+		require.NoError(t, err)
+		require.Equal(t, s, refRes)
+	})
+	require.Equal(t, 4, generatedPointCalls)
+}
+
+func TestGeneratedCodeDetectsCycles(t *testing.T) {
+	p := &generatedPoint{X: 1}
+	p.Next = p
+
+	_, err := Encode(p)
+	require.Error(t, err)
+
+	withReflection(func() {
+		_, refErr := Encode(p)
+		require.Error(t, refErr)
+		require.Equal(t, refErr.Error(), err.Error())
+	})
+	require.Contains(t, err.Error(), "cycle detected through *ezpack.generatedPoint")
+}
+
+func TestGeneratedCodeErrorsMatchReflection(t *testing.T) {
+	type Point struct {
+		Next *generatedPoint `ezpack:"next"`
+		X    int64           `ezpack:"x"`
+	}
+
+	// Out of range for int8
+	outOfRange, err := Encode(Point{X: 300})
+	require.NoError(t, err)
+
+	// Wrong field name
+	wrongName, err := Encode(struct {
+		Y int64 `ezpack:"y"`
+	}{})
+	require.NoError(t, err)
+
+	// Wrong number of fields
+	wrongSize := []byte{PackMapID, 0, 0, 0, 0}
+
+	for _, enc := range [][]byte{outOfRange, wrongName, wrongSize} {
+		var p generatedPoint
+		genErr := DecodeBytes(enc, &p)
+		require.Error(t, genErr)
+
+		withReflection(func() {
+			refErr := DecodeBytes(enc, &p)
+			require.Error(t, refErr)
+			require.Equal(t, refErr.Error(), genErr.Error())
+		})
+	}
+}
+
+func TestGenReadUintAndReadIntEnforceWidth(t *testing.T) {
+	enc, err := PackUint64{Value: 256}.Encode()
+	require.NoError(t, err)
+
+	_, err = genReadUint(bytes.NewReader(enc), reflect.Uint8)
+	require.EqualError(t, err, "value 256 overflows uint8")
+
+	v, err := genReadUint(bytes.NewReader(enc), reflect.Uint16)
+	require.NoError(t, err)
+	require.Equal(t, uint64(256), v)
+
+	enc, err = PackInt64{Value: math.MinInt32 - 1}.Encode()
+	require.NoError(t, err)
+
+	_, err = genReadInt(bytes.NewReader(enc), reflect.Int32)
+	require.EqualError(t, err, "value -2147483649 overflows int32")
+
+	i, err := genReadInt(bytes.NewReader(enc), reflect.Int64)
+	require.NoError(t, err)
+	require.Equal(t, int64(math.MinInt32-1), i)
+}
+
+func TestGenDecodeFieldEnforcesTag(t *testing.T) {
+	enc, err := PackValueSlice{Values: []PackValue{
+		PackString{String: "ab"},
+		PackString{String: "abc"},
+	}}.Encode()
+	require.NoError(t, err)
+
+	var tags []string
+	err = genDecodeField(newDecodeState(), bytes.NewReader(enc), &tags, `ezpack:"tags,2,elemlen=3"`)
+	require.NoError(t, err)
+	require.Equal(t, []string{"ab", "abc"}, tags)
+
+	err = genDecodeField(newDecodeState(), bytes.NewReader(enc), &tags, `ezpack:"tags,2,elemlen=2"`)
+	require.Error(t, err)
+
+	err = genDecodeField(newDecodeState(), bytes.NewReader(enc), tags, `ezpack:"tags,2,elemlen=3"`)
+	require.EqualError(t, err, "DecodeField requires non-nil pointer, not slice")
+}
+
+// release has struct tags and its own Marshaler and Unmarshaler, which are
+// only used when it is a field. At the top level and as a union variant it is
+// handled by reflection
+type release struct {
+	Major uint64 `ezpack:"major"`
+	Minor uint64 `ezpack:"minor"`
+}
+
+func (r release) MarshalEzpack() (PackValue, error) {
+	return PackString{String: fmt.Sprintf("%d.%d", r.Major, r.Minor)}, nil
+}
+
+func (r *release) UnmarshalEzpack(pv PackValue) error {
+	s, ok := pv.(PackString)
+	if !ok {
+		return fmt.Errorf("release must be a string, not %T", pv)
+	}
+	_, err := fmt.Sscanf(s.String, "%d.%d", &r.Major, &r.Minor)
+	return err
+}
+
+func (release) isArtifact() {}
+
+// artifact is a union whose only variant is release
+type artifact interface {
+	isArtifact()
+}
+
+func init() {
+	err := RegisterUnion(reflect.TypeOf((*artifact)(nil)).Elem(), map[string]reflect.Type{
+		"release": reflect.TypeOf(release{}),
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestMarshalerStructsRoundTripAtTopLevel(t *testing.T) {
+	r := release{Major: 1, Minor: 2}
+
+	enc, err := Encode(r)
+	require.NoError(t, err)
+
+	var res release
+	err = DecodeBytes(enc, &res)
+	require.NoError(t, err)
+	require.Equal(t, r, res)
+
+	// As a union variant
+	type Struct struct {
+		A artifact `ezpack:"a,union"`
+	}
+
+	enc, err = Encode(Struct{A: r})
+	require.NoError(t, err)
+
+	var resStruct Struct
+	err = DecodeBytes(enc, &resStruct)
+	require.NoError(t, err)
+	require.Equal(t, Struct{A: r}, resStruct)
+
+	// As a field, the Marshaler is used
+	type Field struct {
+		R release `ezpack:"r,3"`
+	}
+
+	enc, err = Encode(Field{R: r})
+	require.NoError(t, err)
+	require.Equal(t, []byte{PackStringID, 0, 0, 0, 3, '1', '.', '2'}, enc[len(enc)-8:])
+
+	var resField Field
+	err = DecodeBytes(enc, &resField)
+	require.NoError(t, err)
+	require.Equal(t, Field{R: r}, resField)
+}
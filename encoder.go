@@ -0,0 +1,192 @@
+package ezpack
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Encoder writes encoded structs to an io.Writer. Each value is written as it
+// is encoded rather than being assembled into one buffer first, so the output
+// is not buffered: wrap the writer in a bufio.Writer if writes are expensive
+type Encoder struct {
+	w io.Writer
+}
+
+// NewEncoder returns an Encoder writing to w
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{
+		w: w,
+	}
+}
+
+// Encode writes the encoding of o, which must be a struct or a pointer to
+// one, to the stream. The bytes written are identical to those returned by
+// Encode
+func (e *Encoder) Encode(o interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("recovered panic in Encoder.Encode: %s", r)
+		}
+	}()
+
+	// Take the value of the interface{} object, dereferencing once if passed
+	// a pointer
+	v := topLevelValue(o)
+
+	// Convert v (should be struct) to PackMap, our internal representation of a
+	// msgpack map
+	mte, err := structToPackMap(v, newEncodeState())
+	if err != nil {
+		return err
+	}
+
+	// Check the whole message first, so that it fails the same way as Encode
+	// (e.g. if it's too long) and nothing is written if it can't be encoded
+	_, err = mte.Size()
+	if err != nil {
+		return err
+	}
+
+	// Write PackMap to the stream
+	return mte.EncodeTo(e.w)
+}
+
+// writeHeader writes the 5 byte header used by variable length types: a type
+// identifier followed by a big endian length
+func writeHeader(w io.Writer, id byte, length int) error {
+	// Ensure the length fits, even on 32-bit systems
+	if (length < 0) || (length > math.MaxInt32) {
+		return ErrOverflow
+	}
+
+	var header [5]byte
+	header[0] = id
+	binary.BigEndian.PutUint32(header[1:], uint32(length))
+
+	_, err := w.Write(header[:])
+	return err
+}
+
+// writeEncoding writes the result of Encode to w. This is used by fixed size
+// types, whose encodings are small
+func writeEncoding(w io.Writer, pv PackValue) error {
+	enc, err := pv.Encode()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(enc)
+	return err
+}
+
+func (pv PackNil) EncodeTo(w io.Writer) error {
+	return writeEncoding(w, pv)
+}
+
+func (pv PackUint64) EncodeTo(w io.Writer) error {
+	return writeEncoding(w, pv)
+}
+
+func (pv PackInt64) EncodeTo(w io.Writer) error {
+	return writeEncoding(w, pv)
+}
+
+func (pv PackBool) EncodeTo(w io.Writer) error {
+	return writeEncoding(w, pv)
+}
+
+func (pv PackFloat32) EncodeTo(w io.Writer) error {
+	return writeEncoding(w, pv)
+}
+
+func (pv PackFloat64) EncodeTo(w io.Writer) error {
+	return writeEncoding(w, pv)
+}
+
+func (pv PackTimestamp) EncodeTo(w io.Writer) error {
+	return writeEncoding(w, pv)
+}
+
+func (pv PackExt) EncodeTo(w io.Writer) error {
+	// Write header, then the extension type
+	err := writeHeader(w, PackExt32ID, len(pv.Data))
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write([]byte{byte(pv.Type)})
+	if err != nil {
+		return err
+	}
+
+	// Write data directly, without copying it
+	_, err = w.Write(pv.Data)
+	return err
+}
+
+func (pv PackBytes) EncodeTo(w io.Writer) error {
+	// Write header
+	err := writeHeader(w, PackBytesID, len(pv.Bytes))
+	if err != nil {
+		return err
+	}
+
+	// Write data directly, without copying it
+	_, err = w.Write(pv.Bytes)
+	return err
+}
+
+func (pv PackString) EncodeTo(w io.Writer) error {
+	// Write header
+	err := writeHeader(w, PackStringID, len(pv.String))
+	if err != nil {
+		return err
+	}
+
+	// Write data
+	_, err = io.WriteString(w, pv.String)
+	return err
+}
+
+func (pv PackValueSlice) EncodeTo(w io.Writer) error {
+	// Write header
+	err := writeHeader(w, PackArrayID, len(pv.Values))
+	if err != nil {
+		return err
+	}
+
+	// Write each value in turn
+	for _, elt := range pv.Values {
+		err = elt.EncodeTo(w)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (pv PackMap) EncodeTo(w io.Writer) error {
+	// Write header
+	err := writeHeader(w, PackMapID, len(pv.Elements))
+	if err != nil {
+		return err
+	}
+
+	// Write each key and value in turn
+	for _, elt := range pv.Elements {
+		err = elt.Key.EncodeTo(w)
+		if err != nil {
+			return err
+		}
+
+		err = elt.Value.EncodeTo(w)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -1,12 +1,15 @@
 package ezpack
 
 import (
-	"bytes"
+	"encoding"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"math"
+	"math/big"
 	"reflect"
+	"sort"
+	"time"
 )
 
 var ErrOverflow = errors.New("integer overflow during encoding")
@@ -19,15 +22,56 @@ func Encode(o interface{}) (res []byte, err error) {
 		}
 	}()
 
-	// Convert o (should be struct or struct ptr) to PackMap, our
-	// internal representation of a msgpack map
-	mte, err := structToPackMap(o)
+	// Take the value of the interface{} object, dereferencing once if passed
+	// a pointer
+	v := topLevelValue(o)
+
+	// Convert v (should be struct) to PackMap, our internal representation of a
+	// msgpack map
+	mte, err := structToPackMap(v, newEncodeState())
 	if err != nil {
 		return nil, err
 	}
 
 	// Encode PackMap as bytes
-	return mte.Encode()
+	return appendPackValue(nil, mte)
+}
+
+// EncodeValue is like Encode, but accepts any supported value at the top level
+// rather than only structs. There is no struct tag at the top level, so limits
+// gives the options to apply instead (e.g. Union for an interface value)
+func EncodeValue(o interface{}, limits Limits) (res []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("recovered panic in EncodeValue: %s", r)
+		}
+	}()
+
+	// Take the value of the interface{} object, dereferencing once if passed
+	// a pointer
+	v := topLevelValue(o)
+	if !v.IsValid() {
+		return nil, errors.New("EncodeValue requires non-nil value")
+	}
+
+	ezst, err := limits.tag()
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert v to our internal representation
+	pv, err := valueToPackValue(v, ezst, newEncodeState())
+	if err != nil {
+		return nil, err
+	}
+
+	// Encode as bytes
+	return pv.Encode()
+}
+
+func (pv PackNil) Encode() ([]byte, error) {
+	// nil is encoded as a single type identifier byte
+	return []byte{PackNilID}, nil
 }
 
 func (pv PackUint64) Encode() ([]byte, error) {
@@ -43,6 +87,116 @@ func (pv PackUint64) Encode() ([]byte, error) {
 	return buf, nil
 }
 
+func (pv PackInt64) Encode() ([]byte, error) {
+	// Allocate enough space
+	buf := make([]byte, 9)
+
+	// First byte: type identifier
+	buf[0] = PackInt64ID
+
+	// Next 8 bytes: big endian two's complement integer value
+	binary.BigEndian.PutUint64(buf[1:], uint64(pv.Value))
+
+	return buf, nil
+}
+
+func (pv PackBool) Encode() ([]byte, error) {
+	// Booleans are encoded as a single type identifier byte
+	if pv.Value {
+		return []byte{PackTrueID}, nil
+	}
+	return []byte{PackFalseID}, nil
+}
+
+func (pv PackFloat32) Encode() ([]byte, error) {
+	// Allocate enough space
+	buf := make([]byte, 5)
+
+	// First byte: type identifier
+	buf[0] = PackFloat32ID
+
+	// Next 4 bytes: big endian IEEE 754 value, with NaN made canonical
+	bits := math.Float32bits(pv.Value)
+	if math.IsNaN(float64(pv.Value)) {
+		bits = CanonicalNaN32
+	}
+	binary.BigEndian.PutUint32(buf[1:], bits)
+
+	return buf, nil
+}
+
+func (pv PackFloat64) Encode() ([]byte, error) {
+	// Allocate enough space
+	buf := make([]byte, 9)
+
+	// First byte: type identifier
+	buf[0] = PackFloat64ID
+
+	// Next 8 bytes: big endian IEEE 754 value, with NaN made canonical
+	bits := math.Float64bits(pv.Value)
+	if math.IsNaN(pv.Value) {
+		bits = CanonicalNaN64
+	}
+	binary.BigEndian.PutUint64(buf[1:], bits)
+
+	return buf, nil
+}
+
+func (pv PackTimestamp) Encode() ([]byte, error) {
+	// Ensure nanoseconds are in range, otherwise one instant could have more
+	// than one encoding
+	if pv.Nanoseconds >= 1e9 {
+		return nil, fmt.Errorf("timestamp nanoseconds %d out of range", pv.Nanoseconds)
+	}
+
+	// Allocate enough space
+	buf := make([]byte, 3+PackTimestampLen)
+
+	// First three bytes: type identifier, data length and extension type
+	buf[0] = PackExt8ID
+	buf[1] = PackTimestampLen
+	buf[2] = PackTimestampExtType & 0xFF
+
+	// Next 4 bytes: big endian nanoseconds
+	binary.BigEndian.PutUint32(buf[3:7], pv.Nanoseconds)
+
+	// Next 8 bytes: big endian two's complement seconds
+	binary.BigEndian.PutUint64(buf[7:], uint64(pv.Seconds))
+
+	return buf, nil
+}
+
+func (pv PackExt) Encode() ([]byte, error) {
+	// Ensure we don't overflow when allocating space, even on 32-bit systems
+	n := len(pv.Data) + 6
+	if (n <= 0) || (n > math.MaxInt32) || (len(pv.Data) > math.MaxInt32) {
+		return nil, ErrOverflow
+	}
+
+	// Allocate enough space
+	buf := make([]byte, n)
+
+	// First byte: type identifier. We always use ext32 so that each extension
+	// value has exactly one encoding
+	buf[0] = PackExt32ID
+
+	// Next four bytes: big endian data length
+	binary.BigEndian.PutUint32(buf[1:5], uint32(len(pv.Data)))
+
+	// Next byte: extension type
+	buf[5] = byte(pv.Type)
+
+	// Rest of bytes are data
+	c := copy(buf[6:], pv.Data)
+
+	// Sanity check, should have copied all the bytes
+	if c != len(pv.Data) {
+		return nil, ErrCopyingBytes
+	}
+
+	return buf, nil
+}
+
 func (pv PackBytes) Encode() ([]byte, error) {
 	// Ensure we don't overflow when allocating space, even on 32-bit systems
 	n := len(pv.Bytes) + 5
@@ -98,245 +252,520 @@ func (pv PackString) Encode() ([]byte, error) {
 }
 
 func (pv PackValueSlice) Encode() ([]byte, error) {
-	// Ensure we don't overflow when allocating space, even on 32-bit systems
-	n := len(pv.Values) + 1
-	if (n <= 0) || (n > math.MaxInt32) || (len(pv.Values) > math.MaxInt32) {
-		return nil, ErrOverflow
-	}
-
-	// Allocate space for all of the encodings + the header
-	encodings := make([][]byte, 0, n)
-
-	// Allocate space for map header
-	header := make([]byte, 5)
+	// Encode into a single buffer of exactly the right size, rather than
+	// encoding each value separately and joining them together
+	return appendPackValue(nil, pv)
+}
 
-	// First byte: type identifier
-	header[0] = PackArrayID
+func (pv PackMap) Encode() ([]byte, error) {
+	// Encode into a single buffer of exactly the right size, rather than
+	// encoding each key and value separately and joining them together
+	return appendPackValue(nil, pv)
+}
 
-	// Next four bytes: big endian array length
-	binary.BigEndian.PutUint32(header[1:], uint32(len(pv.Values)))
+// pointerKey identifies a pointer we are currently encoding through. The type
+// is included because a struct and its first field share an address
+type pointerKey struct {
+	ptr uintptr
+	typ reflect.Type
+}
 
-	// Append header to slice of all encodings
-	encodings = append(encodings, header)
+// encodeState holds state shared across a single call to Encode
+type encodeState struct {
+	// pointers contains the pointers on the path from the top-level struct to
+	// the value currently being encoded, so that we can detect cycles
+	pointers map[pointerKey]bool
+}
 
-	// Iterate over values and append encoding of each
-	for _, elt := range pv.Values {
-		// Encode the value
-		venc, err := elt.Encode()
-		if err != nil {
-			return nil, err
-		}
+func newEncodeState() *encodeState {
+	return &encodeState{
+		pointers: make(map[pointerKey]bool),
+	}
+}
 
-		// Append the value encoding
-		encodings = append(encodings, venc)
+// enter records that we are encoding through the pointer or map v, returning
+// an error if we are already doing so. Callers must call leave when done
+func (es *encodeState) enter(v reflect.Value) (pointerKey, error) {
+	key := pointerKey{
+		ptr: v.Pointer(),
+		typ: v.Type(),
+	}
+	if es.pointers[key] {
+		return key, fmt.Errorf("cycle detected through %s", v.Type())
 	}
 
-	// Join the encodings together and return
-	return bytes.Join(encodings, nil), nil
+	es.pointers[key] = true
+	return key, nil
 }
 
-func (pv PackMap) Encode() ([]byte, error) {
-	// Ensure we don't overflow when allocating space, even on 32-bit systems
-	n := len(pv.Elements) + 1
-	if (n <= 0) || (n > math.MaxInt32) || (len(pv.Elements) > math.MaxInt32) {
-		return nil, ErrOverflow
+// leave undoes a successful call to enter
+func (es *encodeState) leave(key pointerKey) {
+	delete(es.pointers, key)
+}
+
+func structToPackMap(v reflect.Value, es *encodeState) (*PackMap, error) {
+	// At this point we should have a struct
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("structToPackMap requires struct, not %s", v.Kind())
 	}
 
-	// Allocate space for all of the encodings + the header
-	encodings := make([][]byte, 0, n)
+	// Structs with code generated by ezpackgen build the map themselves
+	if g, ok := generatedEncoderFor(v); ok {
+		return g.EncodeEzpack(es)
+	}
 
-	// Allocate space for map header
-	header := make([]byte, 5)
+	// Type returns the user-defined struct type
+	t := v.Type()
 
-	// First byte: type identifier
-	header[0] = PackMapID
+	// Fetch this struct's fields, sorted alphabetically. This also checks that
+	// we're not encoding too many fields. Structs with no fields are fine, they
+	// are just encoded as an empty map
+	fields, err := planFor(t)
+	if err != nil {
+		return nil, err
+	}
 
-	// Next four bytes: big endian map length
-	binary.BigEndian.PutUint32(header[1:], uint32(len(pv.Elements)))
+	// mapToEncode will contain PackValues for each field in this struct. We will
+	// fill this in (potentially recursively) and finish with mapToEncode.Encode()
+	var mapToEncode PackMap
+	mapToEncode.Elements = make([]PackMapElement, 0, len(fields))
 
-	// Append header to slice of all encodings
-	encodings = append(encodings, header)
+	// Iterate over the struct's fields
+	for _, field := range fields {
+		// Fetch the value of the field
+		fieldValue := v.FieldByIndex(field.index)
 
-	// Iterate over sorted keys and append encoding of each key, value
-	for _, elt := range pv.Elements {
-		// Encode the key
-		kenc, err := elt.Key.Encode()
+		// Build our internal representation of the value to encode
+		fieldName := field.parsedStructTag.FieldName
+		pv, err := field.encode(fieldValue, es)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("error encoding '%s': %w", fieldName, err)
 		}
 
-		// Append the key encoding
-		encodings = append(encodings, kenc)
+		// Add the new map element
+		mapToEncode.Elements = append(mapToEncode.Elements, PackMapElement{
+			Key: PackString{
+				String: fieldName,
+			},
+			Value: pv,
+		})
+	}
 
-		// Encode the value
-		venc, err := elt.Value.Encode()
-		if err != nil {
-			return nil, err
-		}
+	return &mapToEncode, nil
+}
 
-		// Append the value encoding
-		encodings = append(encodings, venc)
+// marshalerFor returns v as a Marshaler if its type implements it, either
+// directly or with a pointer receiver
+func marshalerFor(v reflect.Value) (Marshaler, bool) {
+	i, ok := methodReceiver(v, marshalerType)
+	if !ok {
+		return nil, false
 	}
 
-	// Join the encodings together and return
-	return bytes.Join(encodings, nil), nil
+	return i.(Marshaler), true
 }
 
-func structToPackMap(o interface{}) (*PackMap, error) {
-	// Take the value of the interface{} object
-	v := reflect.ValueOf(o)
-
-	// Dereference once if passed pointer
-	if v.Kind() == reflect.Ptr {
-		// Elem returns the value that the pointer points to
-		v = v.Elem()
+// stdMarshal calls MarshalBinary or MarshalText on v, as selected by the binary
+// or text option in ezst. ok is false if v doesn't implement the selected
+// interface
+func stdMarshal(v reflect.Value, ezst ezPackStructTag) (enc []byte, ok bool, err error) {
+	if ezst.Binary {
+		i, ok := methodReceiver(v, binaryMarshalerType)
+		if !ok {
+			return nil, false, nil
+		}
+		enc, err = i.(encoding.BinaryMarshaler).MarshalBinary()
+		return enc, true, err
 	}
 
-	// At this point we should have a struct
-	if v.Kind() != reflect.Struct {
-		return nil, fmt.Errorf("structToPackMap requires struct, not %s", v.Kind())
+	i, ok := methodReceiver(v, textMarshalerType)
+	if !ok {
+		return nil, false, nil
 	}
+	enc, err = i.(encoding.TextMarshaler).MarshalText()
+	return enc, true, err
+}
 
-	// Type returns the user-defined struct type
-	t := v.Type()
+// checkPackValue ensures that pv, as returned by a Marshaler, is one of our
+// own PackValue types and is canonical under the struct tag parameters in ezst
+func checkPackValue(pv PackValue, ezst ezPackStructTag) error {
+	switch p := pv.(type) {
+	case PackNil, PackUint64, PackInt64, PackBool, PackBytes, PackString:
+		return nil
+	case PackExt:
+		if p.Type < 0 {
+			return fmt.Errorf("extension type %d is reserved", p.Type)
+		}
+		return nil
+	case PackTimestamp:
+		if p.Nanoseconds >= 1e9 {
+			return fmt.Errorf("timestamp nanoseconds %d out of range", p.Nanoseconds)
+		}
+		return nil
+	case PackFloat32:
+		return checkCanonicalFloat(float64(p.Value), ezst)
+	case PackFloat64:
+		return checkCanonicalFloat(p.Value, ezst)
+	case PackValueSlice:
+		elTag := ezst.elemTag()
+		for i, elt := range p.Values {
+			err := checkPackValue(elt, elTag)
+			if err != nil {
+				return fmt.Errorf("error checking index %d: %w", i, err)
+			}
+		}
+		return nil
+	case *PackMap:
+		if p == nil {
+			return fmt.Errorf("got nil *PackMap")
+		}
+		return checkPackValue(*p, ezst)
+	case PackMap:
+		elTag := ezst.elemTag()
+		for i, elt := range p.Elements {
+			if i > 0 {
+				err := checkKeyOrder(p.Elements[i-1].Key.String, elt.Key.String)
+				if err != nil {
+					return err
+				}
+			}
 
-	// Sanity check that we're not encoding too many fields
-	numFields := v.NumField()
-	if (numFields <= 0) || (numFields > math.MaxInt32) {
-		return nil, fmt.Errorf("cannot encode massive struct or struct with no fields")
+			err := checkPackValue(elt.Value, elTag)
+			if err != nil {
+				return fmt.Errorf("error checking key '%s': %w", elt.Key.String, err)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported PackValue type %T", pv)
 	}
+}
 
-	// mapToEncode will contain PackValues for each field in this struct. We will
-	// fill this in (potentially recursively) and finish with mapToEncode.Encode()
-	var mapToEncode PackMap
-	mapToEncode.Elements = make([]PackMapElement, 0, numFields)
+// valueToPackValue builds our internal representation of v according to its
+// type. ezst holds the struct tag parameters of the field v came from
+func valueToPackValue(v reflect.Value, ezst ezPackStructTag, es *encodeState) (PackValue, error) {
+	// Fields tagged binary or text are carried as bytes or a string using the
+	// standard library's marshaling interfaces
+	if ezst.Binary || ezst.Text {
+		enc, ok, err := stdMarshal(v, ezst)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			if ezst.Binary {
+				return PackBytes{
+					Bytes: enc,
+				}, nil
+			}
+			return PackString{
+				String: string(enc),
+			}, nil
+		}
 
-	// Sort this struct's fields alphabetically
-	parsedFields, err := sortStructFields(t)
-	if err != nil {
-		return nil, err
+		// Otherwise the option must apply to the pointee or elements of v
+		switch v.Kind() {
+		case reflect.Ptr, reflect.Map, reflect.Array, reflect.Slice:
+		default:
+			iface := "encoding.TextMarshaler"
+			if ezst.Binary {
+				iface = "encoding.BinaryMarshaler"
+			}
+			return nil, fmt.Errorf("%s does not implement %s", v.Type(), iface)
+		}
 	}
 
-	// Iterate over the struct's fields
-	for _, parsedField := range parsedFields {
-		// Fetch the StructField from the type (info like name, struct tag, etc.)
-		structField := t.Field(parsedField.offset)
+	// Registered extension types are encoded as msgpack extensions
+	if et, ok := lookupExt(v.Type()); ok {
+		return et.encodeExt(v)
+	}
 
-		// Fetch the value of the field
-		fieldValue := v.Field(parsedField.offset)
+	// Types that know how to marshal themselves take priority over their kind
+	if m, ok := marshalerFor(v); ok {
+		pv, err := m.MarshalEzpack()
+		if err != nil {
+			return nil, err
+		}
 
-		// Start building the map element for this field
-		mapEl := PackMapElement{
-			Key: PackString{
-				String: parsedField.parsedStructTag.FieldName,
-			},
+		// Ensure the result is something we can encode canonically
+		err = checkPackValue(pv, ezst)
+		if err != nil {
+			return nil, fmt.Errorf("MarshalEzpack returned invalid value: %w", err)
 		}
 
-		// Build our internal representation of the values to encode according to
-		// to the types of the underlying fields
-		switch kind := structField.Type.Kind(); kind {
-		case reflect.Array:
-			// Got an array, copy it into a slice for encoding (we can't always call
-			// fieldValue.Slice() because fieldValue might not be addressable)
-			elType := structField.Type.Elem()
-			elKind := elType.Kind()
+		return pv, nil
+	}
 
-			// We only support arrays of byte or uint8
-			if elKind != reflect.Uint8 {
-				return nil, fmt.Errorf("only arrays of byte or uint8 are supported")
-			}
+	return kindToPackValue(v, ezst, es)
+}
 
-			// Save the old field value so that we can copy its values into the slice
-			oldFieldValue := fieldValue
-			oldFieldLen := oldFieldValue.Len()
-
-			// Make the new slice and copy in the values
-			sliceType := reflect.SliceOf(elType)
-			fieldValue = reflect.MakeSlice(sliceType, oldFieldLen, oldFieldLen)
-			for i := 0; i < oldFieldLen; i++ {
-				// Grab the slice entry at index i and ensure we can set the value
-				sliceEntry := fieldValue.Index(i)
-				if !sliceEntry.CanSet() {
-					return nil, fmt.Errorf("could not call Set() when encoding %s", structField.Name)
-				}
+// kindToPackValue builds our internal representation of v according to its
+// kind alone, without checking for extension types or marshaling interfaces.
+// ezst holds the struct tag parameters of the field v came from
+func kindToPackValue(v reflect.Value, ezst ezPackStructTag, es *encodeState) (PackValue, error) {
+	switch kind := v.Kind(); kind {
+	case reflect.Ptr:
+		// Only pointers to values that can't be nil are supported
+		err := checkPointerType(v.Type())
+		if err != nil {
+			return nil, err
+		}
+
+		// nil pointers are encoded as msgpack nil
+		if v.IsNil() {
+			return PackNil{}, nil
+		}
 
-				// Write the copied value
-				sliceEntry.Set(oldFieldValue.Index(i))
+		// Ensure we aren't already encoding through this pointer
+		key, err := es.enter(v)
+		if err != nil {
+			return nil, err
+		}
+		defer es.leave(key)
+
+		// Encode the pointee
+		return valueToPackValue(v.Elem(), ezst, es)
+	case reflect.Map:
+		// We only support maps with string keys
+		keyKind := v.Type().Key().Kind()
+		if keyKind != reflect.String {
+			return nil, fmt.Errorf("can only encode maps with string keys, not %s", keyKind)
+		}
+
+		// Ensure we aren't already encoding through this map
+		key, err := es.enter(v)
+		if err != nil {
+			return nil, err
+		}
+		defer es.leave(key)
+
+		// Sort the keys bytewise, the same way we sort struct fields
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+
+		// Build the map element for each key
+		elTag := ezst.elemTag()
+		mapToEncode := PackMap{
+			Elements: make([]PackMapElement, 0, len(keys)),
+		}
+		for _, k := range keys {
+			// Convert the value to a PackValue
+			pv, err := valueToPackValue(v.MapIndex(k), elTag, es)
+			if err != nil {
+				return nil, fmt.Errorf("error encoding key '%s': %w", k.String(), err)
 			}
 
-			// Now we can just encode as we would any other slice
-			fallthrough
-		case reflect.Slice:
-			// Got a slice, check if it's a slice of bytes or structs
-			elType := structField.Type.Elem()
-			elKind := elType.Kind()
-
-			switch elKind {
-			case reflect.Uint8:
-				// Byte slice: build ezpack struct to be encoded
-				mapEl.Value = PackBytes{
-					Bytes: fieldValue.Bytes(),
-				}
-			case reflect.Struct:
-				// Struct: convert each one to a PackValue
-				var values []PackValue
-				for i := 0; i < fieldValue.Len(); i++ {
-					// Fetch the value at each index
-					valueAtIdx := fieldValue.Index(i)
-
-					// Ensure we can convert each value to an interface
-					if !valueAtIdx.CanInterface() {
-						return nil, fmt.Errorf("could not convert %s[%d] to interface", structField.Name, i)
-					}
-
-					// Convert each struct to a pack map
-					vmap, err := structToPackMap(valueAtIdx.Interface())
-					if err != nil {
-						return nil, err
-					}
-
-					// Add to the slice of values to be encoded
-					values = append(values, vmap)
-				}
+			// Add the new map element
+			mapToEncode.Elements = append(mapToEncode.Elements, PackMapElement{
+				Key: PackString{
+					String: k.String(),
+				},
+				Value: pv,
+			})
+		}
 
-				// Build ezpack struct to be encoded
-				mapEl.Value = PackValueSlice{
-					Values: values,
+		return mapToEncode, nil
+	case reflect.Array:
+		// Arrays of anything other than bytes are encoded as msgpack arrays,
+		// with each element converted using the element parameters from the tag
+		elType := v.Type().Elem()
+		if elType.Kind() != reflect.Uint8 {
+			elTag := ezst.elemTag()
+			values := make([]PackValue, 0, v.Len())
+			for i := 0; i < v.Len(); i++ {
+				pv, err := valueToPackValue(v.Index(i), elTag, es)
+				if err != nil {
+					return nil, fmt.Errorf("error encoding index %d: %w", i, err)
 				}
-			default:
-				return nil, fmt.Errorf("can only encode slices of byte, uint8, or struct, not %s", elKind)
-			}
-		case reflect.String:
-			// Build ezpack struct to be encoded
-			mapEl.Value = PackString{
-				String: fieldValue.String(),
+
+				// Add to the slice of values to be encoded
+				values = append(values, pv)
 			}
-		case reflect.Uint64:
+
 			// Build ezpack struct to be encoded
-			mapEl.Value = PackUint64{
-				Value: fieldValue.Uint(),
-			}
-		case reflect.Struct:
-			// Ensure we can convert this field value to an interface
-			if !fieldValue.CanInterface() {
-				return nil, fmt.Errorf("could not convert %s to interface", structField.Name)
+			return PackValueSlice{
+				Values: values,
+			}, nil
+		}
+
+		// Got a byte array, copy it into a slice for encoding (we can't always
+		// call v.Slice() because v might not be addressable). Make the new slice
+		// and copy in the values
+		sliceType := reflect.SliceOf(elType)
+		sliceValue := reflect.MakeSlice(sliceType, v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			// Grab the slice entry at index i and ensure we can set the value
+			sliceEntry := sliceValue.Index(i)
+			if !sliceEntry.CanSet() {
+				return nil, fmt.Errorf("could not call Set() when encoding index %d", i)
 			}
 
-			// Recursively encode this map
-			fmap, err := structToPackMap(fieldValue.Interface())
+			// Write the copied value
+			sliceEntry.Set(v.Index(i))
+		}
+
+		// Now we can just encode as we would any other slice
+		return valueToPackValue(sliceValue, ezst, es)
+	case reflect.Slice:
+		// Byte slices are encoded as msgpack bin
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return PackBytes{
+				Bytes: v.Bytes(),
+			}, nil
+		}
+
+		// Anything else is encoded as a msgpack array, with each element
+		// converted to a PackValue using the element parameters from the tag
+		elTag := ezst.elemTag()
+		values := make([]PackValue, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			pv, err := valueToPackValue(v.Index(i), elTag, es)
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("error encoding index %d: %w", i, err)
 			}
 
-			// Set child map to be encoded
-			mapEl.Value = fmap
-		default:
-			return nil, fmt.Errorf("structToPackMap does not know how to handle %s", kind)
+			// Add to the slice of values to be encoded
+			values = append(values, pv)
 		}
 
-		// Add the new map element
-		mapToEncode.Elements = append(mapToEncode.Elements, mapEl)
+		// Build ezpack struct to be encoded
+		return PackValueSlice{
+			Values: values,
+		}, nil
+	case reflect.String:
+		// Build ezpack struct to be encoded
+		return PackString{
+			String: v.String(),
+		}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		// All unsigned integers are carried as uint64. Note that uint is only
+		// 32 bits wide on 32-bit platforms, but Uint() always widens to uint64
+		return PackUint64{
+			Value: v.Uint(),
+		}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		// All signed integers are encoded as int64 so that each value has
+		// exactly one representation on the wire
+		return PackInt64{
+			Value: v.Int(),
+		}, nil
+	case reflect.Float32, reflect.Float64:
+		// Apply the float policy from the struct tag
+		f, err := canonicalFloat(v.Float(), ezst)
+		if err != nil {
+			return nil, err
+		}
+
+		// Build ezpack struct to be encoded, preserving the width of the field
+		if kind == reflect.Float32 {
+			return PackFloat32{
+				Value: float32(f),
+			}, nil
+		}
+		return PackFloat64{
+			Value: f,
+		}, nil
+	case reflect.Bool:
+		// Build ezpack struct to be encoded
+		return PackBool{
+			Value: v.Bool(),
+		}, nil
+	case reflect.Struct:
+		// time.Time is encoded as a msgpack timestamp. Only the instant is
+		// encoded, so the location and monotonic clock reading are dropped
+		if v.Type() == timeType {
+			t := v.Interface().(time.Time)
+			return PackTimestamp{
+				Seconds:     t.Unix(),
+				Nanoseconds: uint32(t.Nanosecond()),
+			}, nil
+		}
+
+		// big.Int is encoded as bin holding a sign byte and minimal magnitude
+		if v.Type() == bigIntType {
+			b := v.Interface().(big.Int)
+			return bigIntToPackValue(&b), nil
+		}
+
+		// Recursively encode this map
+		return structToPackMap(v, es)
+	case reflect.Interface:
+		// Interfaces are only supported as tagged unions
+		if !ezst.Union {
+			return nil, fmt.Errorf("interface fields require the union option")
+		}
+		return unionToPackValue(v, es)
+	default:
+		return nil, fmt.Errorf("valueToPackValue does not know how to handle %s", kind)
+	}
+}
+
+// bigIntToPackValue builds our internal representation of b: a sign byte
+// followed by the big endian magnitude, with no leading zero bytes. Zero is
+// always non-negative and has an empty magnitude
+func bigIntToPackValue(b *big.Int) PackBytes {
+	sign := byte(BigIntNonNegative)
+	if b.Sign() < 0 {
+		sign = BigIntNegative
 	}
 
-	return &mapToEncode, nil
+	// Bytes returns the absolute value with no leading zero bytes
+	return PackBytes{
+		Bytes: append([]byte{sign}, b.Bytes()...),
+	}
+}
+
+// unionToPackValue builds our internal representation of the interface value
+// v, whose type must be registered with RegisterUnion. A nil interface is
+// encoded as msgpack nil, and anything else as a two-element array of the
+// variant name and the variant encoded as a map
+func unionToPackValue(v reflect.Value, es *encodeState) (PackValue, error) {
+	ut, err := lookupUnion(v.Type())
+	if err != nil {
+		return nil, err
+	}
+
+	// nil interfaces are encoded as msgpack nil
+	if v.IsNil() {
+		return PackNil{}, nil
+	}
+
+	// Find the name of the variant stored in the interface
+	variant := v.Elem()
+	name, ok := ut.byType[variant.Type()]
+	if !ok {
+		return nil, fmt.Errorf("%s is not a registered variant of union %s", variant.Type(), ut.iface)
+	}
+
+	// Pointer variants must not be nil, and we must not already be encoding
+	// through them
+	if variant.Kind() == reflect.Ptr {
+		if variant.IsNil() {
+			return nil, fmt.Errorf("variant '%s' of union %s is a nil pointer", name, ut.iface)
+		}
+
+		key, err := es.enter(variant)
+		if err != nil {
+			return nil, err
+		}
+		defer es.leave(key)
+
+		variant = variant.Elem()
+	}
+
+	// Convert the variant to a PackMap
+	vmap, err := structToPackMap(variant, es)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding variant '%s': %w", name, err)
+	}
+
+	return PackValueSlice{
+		Values: []PackValue{
+			PackString{
+				String: name,
+			},
+			vmap,
+		},
+	}, nil
 }
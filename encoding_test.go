@@ -1,8 +1,15 @@
 package ezpack
 
 import (
+	"bytes"
+	"io"
+	"math"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/justicz/ezpack/internal/genhooks"
 	"github.com/stretchr/testify/require"
 )
 
@@ -110,3 +117,710 @@ func TestCannotEncodeWithBadStructTags(t *testing.T) {
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "duplicate key")
 }
+
+func TestCanEncodeSignedIntFields(t *testing.T) {
+	type Struct struct {
+		Foo int64         `ezpack:"foo"`
+		Bar int32         `ezpack:"bar"`
+		Baz int8          `ezpack:"baz"`
+		Biz int           `ezpack:"biz"`
+		Dur time.Duration `ezpack:"dur"`
+	}
+
+	// Struct containing signed integers should be encodable
+	s := Struct{
+		Foo: -(1 << 63),
+		Bar: (1 << 31) - 1,
+		Baz: -1,
+		Biz: 1234,
+		Dur: -time.Second,
+	}
+
+	_, err := Encode(s)
+	require.NoError(t, err)
+}
+
+func TestCanEncodeNarrowUnsignedFields(t *testing.T) {
+	type Struct struct {
+		Foo uint32 `ezpack:"foo"`
+		Bar uint16 `ezpack:"bar"`
+		Baz uint8  `ezpack:"baz"`
+		Biz uint   `ezpack:"biz"`
+	}
+
+	// Struct containing narrow unsigned integers should be encodable
+	s := Struct{
+		Foo: (1 << 32) - 1,
+		Bar: (1 << 16) - 1,
+		Baz: (1 << 8) - 1,
+		Biz: 1234,
+	}
+
+	_, err := Encode(s)
+	require.NoError(t, err)
+}
+
+func TestCannotEncodePointerCycle(t *testing.T) {
+	type Node struct {
+		Value uint64 `ezpack:"value"`
+		Next  *Node  `ezpack:"next"`
+	}
+
+	// A list without a cycle should be encodable
+	tail := &Node{Value: 2}
+	head := &Node{Value: 1, Next: tail}
+	_, err := Encode(head)
+	require.NoError(t, err)
+
+	// Pointing the tail back at the head should be reported as an error
+	tail.Next = head
+	_, err = Encode(head)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cycle")
+}
+
+func TestCanEncodeScalarSliceFields(t *testing.T) {
+	type Struct struct {
+		Names  []string  `ezpack:"names"`
+		Nums   []uint64  `ezpack:"nums"`
+		Blobs  [][]byte  `ezpack:"blobs"`
+		Flags  []bool    `ezpack:"flags"`
+		Floats []float64 `ezpack:"floats"`
+	}
+
+	// Struct containing slices of scalars should be encodable
+	s := Struct{
+		Names:  []string{"foo", "bar"},
+		Nums:   []uint64{1, 2, 3},
+		Blobs:  [][]byte{[]byte("baz")},
+		Flags:  []bool{true},
+		Floats: []float64{1.5},
+	}
+
+	_, err := Encode(s)
+	require.NoError(t, err)
+}
+
+func TestCanEncodeNonByteArrayFields(t *testing.T) {
+	type Child struct {
+		Foo uint64 `ezpack:"foo"`
+	}
+
+	type Struct struct {
+		Nums     [4]uint64 `ezpack:"nums"`
+		Children [2]Child  `ezpack:"children"`
+		Empty    [0]string `ezpack:"empty"`
+	}
+
+	// Struct containing arrays of non-byte types should be encodable without
+	// a max length in the struct tag
+	s := Struct{
+		Nums:     [4]uint64{1, 2, 3, 4},
+		Children: [2]Child{Child{Foo: 1}, Child{Foo: 2}},
+	}
+
+	_, err := Encode(s)
+	require.NoError(t, err)
+}
+
+func TestCannotEncodeWithBadInlineTags(t *testing.T) {
+	type Header struct {
+		ID uint64 `ezpack:"id"`
+	}
+
+	type NotEmbedded struct {
+		Header Header `ezpack:",inline"`
+	}
+
+	// Only embedded structs can be inline
+	_, err := Encode(NotEmbedded{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "embedded struct")
+
+	type Named struct {
+		Header `ezpack:"header,inline"`
+	}
+
+	// Inline fields cannot have a name
+	_, err = Encode(Named{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot have a name")
+
+	type Untagged struct {
+		Header
+	}
+
+	// Embedded structs still need a struct tag
+	_, err = Encode(Untagged{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "struct tag")
+
+	type DupInline struct {
+		Header `ezpack:",inline"`
+		Other  uint64 `ezpack:"id"`
+	}
+
+	// Duplicate keys should be detected across the flattened fields
+	_, err = Encode(DupInline{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "duplicate key")
+}
+
+func TestCannotEncodeUnexportedFields(t *testing.T) {
+	type Struct struct {
+		Foo uint64 `ezpack:"foo"`
+		bar uint64 `ezpack:"bar"`
+	}
+
+	// Unexported tagged fields should be reported clearly
+	_, err := Encode(Struct{bar: 1})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unexported field 'bar'")
+	require.NotContains(t, err.Error(), "panic")
+}
+
+func TestCanEncodeEmptyStructs(t *testing.T) {
+	type Ping struct{}
+
+	type OnlySkipped struct {
+		Cache string `ezpack:"-"`
+	}
+
+	// Empty structs should encode as an empty map
+	enc, err := Encode(Ping{})
+	require.NoError(t, err)
+	require.Equal(t, []byte{PackMapID, 0, 0, 0, 0}, enc)
+
+	enc, err = Encode(OnlySkipped{Cache: "derived"})
+	require.NoError(t, err)
+	require.Equal(t, []byte{PackMapID, 0, 0, 0, 0}, enc)
+}
+
+// badMarshaler returns whatever PackValue it holds from MarshalEzpack
+type badMarshaler struct {
+	pv PackValue
+}
+
+func (bm badMarshaler) MarshalEzpack() (PackValue, error) {
+	return bm.pv, nil
+}
+
+// otherPackValue is a PackValue that isn't one of ours
+type otherPackValue struct{}
+
+func (otherPackValue) Encode() ([]byte, error) {
+	return []byte{0x00}, nil
+}
+
+func (otherPackValue) EncodeTo(w io.Writer) error {
+	_, err := w.Write([]byte{0x00})
+	return err
+}
+
+func (otherPackValue) AppendTo(dst []byte) ([]byte, error) {
+	return append(dst, 0x00), nil
+}
+
+func (otherPackValue) Size() (int, error) {
+	return 1, nil
+}
+
+func TestCannotEncodeNonCanonicalMarshalerOutput(t *testing.T) {
+	type Struct struct {
+		X badMarshaler `ezpack:"x"`
+	}
+
+	// Unsorted map keys
+	unsorted := PackMap{
+		Elements: []PackMapElement{
+			PackMapElement{Key: PackString{String: "b"}, Value: PackNil{}},
+			PackMapElement{Key: PackString{String: "a"}, Value: PackNil{}},
+		},
+	}
+	_, err := Encode(Struct{X: badMarshaler{unsorted}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not sorted")
+
+	// PackValue types we don't know about
+	_, err = Encode(Struct{X: badMarshaler{otherPackValue{}}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unsupported PackValue")
+
+	_, err = Encode(Struct{X: badMarshaler{nil}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unsupported PackValue")
+}
+
+func TestCannotEncodeStdMarshalerOptionOnOtherTypes(t *testing.T) {
+	type Struct struct {
+		X uint64 `ezpack:"x,text"`
+	}
+
+	_, err := Encode(Struct{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "does not implement encoding.TextMarshaler")
+
+	type Both struct {
+		X uint64 `ezpack:"x,binary,text"`
+	}
+
+	_, err = Encode(Both{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot use both")
+}
+
+func TestTimeIsEncodedDeterministically(t *testing.T) {
+	type Struct struct {
+		At time.Time `ezpack:"at"`
+	}
+
+	// The same instant should encode identically regardless of location or
+	// monotonic clock reading
+	now := time.Now()
+	enc1, err := Encode(Struct{At: now})
+	require.NoError(t, err)
+
+	enc2, err := Encode(Struct{At: now.Round(0).In(time.FixedZone("X", 3600))})
+	require.NoError(t, err)
+	require.Equal(t, enc1, enc2)
+
+	// The timestamp should use the 96-bit extension format
+	ts := enc1[len(enc1)-15:]
+	require.Equal(t, []byte{PackExt8ID, 12, 0xFF}, ts[:3])
+}
+
+// dupExtType is registered as an extension by TestCannotRegisterDuplicateExt
+type dupExtType uint64
+
+func TestCannotRegisterDuplicateExt(t *testing.T) {
+	encode := func(v interface{}) ([]byte, error) { return nil, nil }
+	decode := func(data []byte) (interface{}, error) { return dupExtType(0), nil }
+
+	err := RegisterExt(100, reflect.TypeOf(dupExtType(0)), 8, encode, decode)
+	require.NoError(t, err)
+
+	// Same type code
+	type other uint64
+	err = RegisterExt(100, reflect.TypeOf(other(0)), 8, encode, decode)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "already registered")
+
+	// Same Go type
+	err = RegisterExt(101, reflect.TypeOf(dupExtType(0)), 8, encode, decode)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "already registered")
+
+	// Reserved type code
+	err = RegisterExt(-1, reflect.TypeOf(other(0)), 8, encode, decode)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "reserved")
+
+	// Pointer type
+	err = RegisterExt(102, reflect.TypeOf(new(other)), 8, encode, decode)
+	require.Error(t, err)
+}
+
+// shape is a union used by TestCannotEncodeBadUnions
+type shape interface {
+	isShape()
+}
+
+type square struct {
+	Side uint64 `ezpack:"side"`
+}
+
+func (square) isShape() {}
+
+type circle struct {
+	Radius uint64 `ezpack:"radius"`
+}
+
+func (circle) isShape() {}
+
+func TestCannotEncodeBadUnions(t *testing.T) {
+	err := RegisterUnion(reflect.TypeOf((*shape)(nil)).Elem(), map[string]reflect.Type{
+		"square": reflect.TypeOf(square{}),
+	})
+	require.NoError(t, err)
+
+	// Interface fields need the union option
+	type NoOption struct {
+		Shape shape `ezpack:"shape"`
+	}
+	_, err = Encode(NoOption{Shape: square{}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "union option")
+
+	// Only registered variants can be encoded
+	type Struct struct {
+		Shape shape `ezpack:"shape,union"`
+	}
+	_, err = Encode(Struct{Shape: circle{}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not a registered variant")
+
+	// Each variant can only have one name
+	type other interface{}
+	err = RegisterUnion(reflect.TypeOf((*other)(nil)).Elem(), map[string]reflect.Type{
+		"a": reflect.TypeOf(square{}),
+		"b": reflect.TypeOf(square{}),
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "registered as both")
+
+	// Each interface can only be registered once
+	err = RegisterUnion(reflect.TypeOf((*shape)(nil)).Elem(), nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "already registered")
+}
+
+func TestCanEncodeTopLevelValues(t *testing.T) {
+	type Struct struct {
+		Foo uint64 `ezpack:"foo"`
+	}
+
+	// Structs should encode the same way as with Encode
+	enc, err := Encode(Struct{Foo: 1})
+	require.NoError(t, err)
+
+	encValue, err := EncodeValue(Struct{Foo: 1}, Limits{})
+	require.NoError(t, err)
+	require.Equal(t, enc, encValue)
+
+	// Other values can be encoded directly
+	enc, err = EncodeValue("hello", Limits{})
+	require.NoError(t, err)
+	require.Equal(t, []byte{PackStringID, 0, 0, 0, 5, 'h', 'e', 'l', 'l', 'o'}, enc)
+
+	_, err = EncodeValue([]Struct{Struct{Foo: 1}, Struct{Foo: 2}}, Limits{})
+	require.NoError(t, err)
+}
+
+func TestEncoderMatchesEncode(t *testing.T) {
+	type Child struct {
+		Foo []byte `ezpack:"foo"`
+	}
+
+	type Struct struct {
+		Str      string           `ezpack:"str"`
+		Num      uint64           `ezpack:"num"`
+		Int      int64            `ezpack:"int"`
+		Flag     bool             `ezpack:"flag"`
+		F32      float32          `ezpack:"f32"`
+		F64      float64          `ezpack:"f64"`
+		Nil      *uint64          `ezpack:"nil"`
+		At       time.Time        `ezpack:"at"`
+		Hash     [4]byte          `ezpack:"hash"`
+		Children []Child          `ezpack:"children"`
+		Labels   map[string]Child `ezpack:"labels"`
+	}
+
+	s := Struct{
+		Str:      "hello",
+		Num:      1,
+		Int:      -1,
+		Flag:     true,
+		F32:      1.5,
+		F64:      -2.5,
+		At:       time.Unix(1234, 5678),
+		Hash:     [4]byte{1, 2, 3, 4},
+		Children: []Child{Child{Foo: []byte("a")}, Child{}},
+		Labels:   map[string]Child{"b": Child{Foo: []byte("c")}, "a": Child{}},
+	}
+
+	enc, err := Encode(s)
+	require.NoError(t, err)
+
+	// Write the struct twice to the same stream
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	err = e.Encode(s)
+	require.NoError(t, err)
+	err = e.Encode(&s)
+	require.NoError(t, err)
+
+	require.Equal(t, append(append([]byte{}, enc...), enc...), buf.Bytes())
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter struct {
+	n int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.n += len(p)
+	return len(p), nil
+}
+
+func TestEncoderErrorsMatchEncode(t *testing.T) {
+	type Child struct {
+		Foo []byte `ezpack:"foo"`
+	}
+
+	type Struct struct {
+		Children []Child `ezpack:"children"`
+	}
+
+	// Share one buffer between many children, so that the message is too long
+	// without using much memory
+	big := make([]byte, 1<<24)
+	s := Struct{
+		Children: make([]Child, math.MaxInt32/len(big)+1),
+	}
+	for i := range s.Children {
+		s.Children[i].Foo = big
+	}
+
+	_, err := Encode(s)
+	require.Equal(t, ErrOverflow, err)
+
+	// Nothing should be written
+	var cw countingWriter
+	err = NewEncoder(&cw).Encode(s)
+	require.Equal(t, ErrOverflow, err)
+	require.Equal(t, 0, cw.n)
+
+	// Size should fail whenever encoding would
+	_, err = PackTimestamp{Nanoseconds: 1e9}.Size()
+	require.EqualError(t, err, "timestamp nanoseconds 1000000000 out of range")
+}
+
+func TestAppendEncodeMatchesEncode(t *testing.T) {
+	type Child struct {
+		Foo string `ezpack:"foo"`
+	}
+
+	type Struct struct {
+		Children []Child         `ezpack:"children"`
+		Nested   map[string]bool `ezpack:"nested"`
+		Num      int64           `ezpack:"num"`
+	}
+
+	s := Struct{
+		Children: []Child{Child{Foo: "a"}, Child{Foo: "b"}},
+		Nested:   map[string]bool{"x": true, "y": false},
+		Num:      -5,
+	}
+
+	enc, err := Encode(s)
+	require.NoError(t, err)
+
+	// Appending should leave the existing contents alone
+	prefix := []byte("prefix")
+	res, err := AppendEncode(prefix, s)
+	require.NoError(t, err)
+	require.Equal(t, append([]byte("prefix"), enc...), res)
+
+	// The appended encoding should match the streamed one
+	var buf bytes.Buffer
+	err = NewEncoder(&buf).Encode(s)
+	require.NoError(t, err)
+	require.Equal(t, buf.Bytes(), res[len(prefix):])
+}
+
+func TestPackValueSizeIsExact(t *testing.T) {
+	values := []PackValue{
+		PackNil{},
+		PackUint64{Value: 1},
+		PackInt64{Value: -1},
+		PackBool{Value: true},
+		PackFloat32{Value: 1.5},
+		PackFloat64{Value: -1.5},
+		PackTimestamp{Seconds: -1, Nanoseconds: 5},
+		PackExt{Type: 3, Data: []byte("ext")},
+		PackBytes{Bytes: []byte("bytes")},
+		PackString{String: "string"},
+	}
+	values = append(values, PackValueSlice{Values: values})
+	values = append(values, PackMap{
+		Elements: []PackMapElement{
+			PackMapElement{Key: PackString{String: "a"}, Value: values[len(values)-1]},
+		},
+	})
+
+	for _, pv := range values {
+		n, err := pv.Size()
+		require.NoError(t, err)
+
+		enc, err := pv.AppendTo(nil)
+		require.NoError(t, err)
+		require.Equal(t, n, len(enc), "%T", pv)
+
+		// Every way of encoding should give the same bytes
+		old, err := pv.Encode()
+		require.NoError(t, err)
+		require.Equal(t, old, enc, "%T", pv)
+
+		var buf bytes.Buffer
+		err = pv.EncodeTo(&buf)
+		require.NoError(t, err)
+		require.Equal(t, buf.Bytes(), enc, "%T", pv)
+	}
+}
+
+func TestStructPlansAreCached(t *testing.T) {
+	type Struct struct {
+		B uint64 `ezpack:"b"`
+		A string `ezpack:"a"`
+	}
+
+	typ := reflect.TypeOf(Struct{})
+	fields1, err := planFor(typ)
+	require.NoError(t, err)
+
+	fields2, err := planFor(typ)
+	require.NoError(t, err)
+
+	// The same compiled plan should be returned, with fields sorted
+	require.Same(t, &fields1[0], &fields2[0])
+	require.Equal(t, "a", fields1[0].parsedStructTag.FieldName)
+	require.Equal(t, "b", fields1[1].parsedStructTag.FieldName)
+
+	// Schema errors should be cached and reported consistently
+	type DupTag struct {
+		Foo []byte `ezpack:"dup"`
+		Bar []byte `ezpack:"dup"`
+	}
+
+	_, err1 := Encode(DupTag{})
+	_, err2 := Encode(DupTag{})
+	require.Error(t, err1)
+	require.Equal(t, err1, err2)
+}
+
+// lateExtType is registered as an extension after it has been encoded
+type lateExtType uint64
+
+func TestRegisteringExtInvalidatesPlans(t *testing.T) {
+	type Struct struct {
+		X lateExtType `ezpack:"x"`
+	}
+
+	before, err := Encode(Struct{X: 1})
+	require.NoError(t, err)
+
+	err = RegisterExt(103, reflect.TypeOf(lateExtType(0)), 1,
+		func(v interface{}) ([]byte, error) { return []byte{byte(v.(lateExtType))}, nil },
+		func(data []byte) (interface{}, error) { return lateExtType(data[0]), nil },
+	)
+	require.NoError(t, err)
+
+	// The field should now be encoded as an extension
+	after, err := Encode(Struct{X: 1})
+	require.NoError(t, err)
+	require.NotEqual(t, before, after)
+	require.Equal(t, []byte{PackExt32ID, 0, 0, 0, 1, 103, 1}, after[len(after)-7:])
+}
+
+// racedExtType is registered as an extension while a plan using it is being
+// compiled
+type racedExtType uint64
+
+func TestPlansCompiledBeforeRegistrationAreNotCached(t *testing.T) {
+	type Struct struct {
+		X racedExtType `ezpack:"x"`
+	}
+	st := reflect.TypeOf(Struct{})
+
+	// Compile a plan, then register the extension before storing it, as if
+	// RegisterExt ran while planFor was compiling
+	planCache.RLock()
+	gen := planCache.gen
+	planCache.RUnlock()
+	stale := compilePlan(st)
+
+	err := RegisterExt(104, reflect.TypeOf(racedExtType(0)), 1,
+		func(v interface{}) ([]byte, error) { return []byte{byte(v.(racedExtType))}, nil },
+		func(data []byte) (interface{}, error) { return racedExtType(data[0]), nil },
+	)
+	require.NoError(t, err)
+
+	storePlan(st, stale, gen)
+
+	// The stale plan should have been dropped, so the extension is used
+	enc, err := Encode(Struct{X: 1})
+	require.NoError(t, err)
+	require.Equal(t, []byte{PackExt32ID, 0, 0, 0, 1, 104, 1}, enc[len(enc)-7:])
+}
+
+func TestConcurrentEncodeDecode(t *testing.T) {
+	type Child struct {
+		Foo string `ezpack:"foo,5"`
+	}
+
+	type Struct struct {
+		Children []Child `ezpack:"children,2"`
+		Num      uint64  `ezpack:"num"`
+	}
+
+	s := Struct{
+		Children: []Child{Child{Foo: "a"}, Child{Foo: "b"}},
+		Num:      1234,
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			enc, err := Encode(s)
+			if err != nil {
+				errs <- err
+				return
+			}
+			var res Struct
+			errs <- DecodeBytes(enc, &res)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
+
+func TestGenEncodeFieldMatchesStructField(t *testing.T) {
+	type Struct struct {
+		Floats []float64 `ezpack:"floats,2,normfloat"`
+	}
+
+	s := Struct{Floats: []float64{math.Copysign(0, -1), 1.5}}
+	pv, err := genEncodeField(newEncodeState(), &s.Floats, `ezpack:"floats,2,normfloat"`)
+	require.NoError(t, err)
+
+	// The field's encoding is the tail of the struct's
+	enc, err := Encode(s)
+	require.NoError(t, err)
+	fieldEnc, err := pv.(PackValue).Encode()
+	require.NoError(t, err)
+	require.Equal(t, enc[len(enc)-len(fieldEnc):], fieldEnc)
+
+	_, err = genEncodeField(newEncodeState(), &s.Floats, `ezpack:"floats,2,bogus"`)
+	require.Error(t, err)
+
+	_, err = genEncodeField(newEncodeState(), s.Floats, `ezpack:"floats,2,normfloat"`)
+	require.EqualError(t, err, "EncodeField requires non-nil pointer, not slice")
+}
+
+func TestGenParseTag(t *testing.T) {
+	info, err := genParseTag(`ezpack:"name,16"`, "Name")
+	require.NoError(t, err)
+	require.Equal(t, genhooks.TagInfo{Name: "name", MaxLen: 16}, info)
+
+	info, err = genParseTag(`ezpack:"tags,4,elemlen=8"`, "Tags")
+	require.NoError(t, err)
+	require.Equal(t, genhooks.TagInfo{Name: "tags", MaxLen: 4, HasOptions: true}, info)
+
+	info, err = genParseTag(`ezpack:",inline"`, "Base")
+	require.NoError(t, err)
+	require.True(t, info.Inline)
+
+	info, err = genParseTag(`ezpack:"-"`, "Cache")
+	require.NoError(t, err)
+	require.True(t, info.Skip)
+
+	_, err = genParseTag(`json:"name"`, "Name")
+	require.Error(t, err)
+}
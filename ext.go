@@ -0,0 +1,162 @@
+package ezpack
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// ExtEncoder converts a value of a registered Go type into the data of a
+// msgpack extension. v always has the registered type
+type ExtEncoder func(v interface{}) ([]byte, error)
+
+// ExtDecoder converts the data of a msgpack extension back into a value of the
+// registered Go type
+type ExtDecoder func(data []byte) (interface{}, error)
+
+// extType holds everything we know about a registered extension type
+type extType struct {
+	typeCode int8
+	goType   reflect.Type
+	maxLen   uint32
+	encode   ExtEncoder
+	decode   ExtDecoder
+}
+
+// extRegistry holds the registered extension types, looked up by Go type when
+// encoding and decoding
+var extRegistry = struct {
+	sync.RWMutex
+	byCode map[int8]*extType
+	byType map[reflect.Type]*extType
+}{
+	byCode: make(map[int8]*extType),
+	byType: make(map[reflect.Type]*extType),
+}
+
+// RegisterExt registers goType to be encoded as a msgpack extension with the
+// given type code. The extension data is produced by encode and consumed by
+// decode, and may be at most maxLen bytes long. Negative type codes are
+// reserved by msgpack, and each type code and Go type may only be registered
+// once
+func RegisterExt(typeCode int8, goType reflect.Type, maxLen uint32, encode ExtEncoder, decode ExtDecoder) error {
+	// Negative type codes are reserved by the msgpack spec (e.g. -1 for
+	// timestamps)
+	if typeCode < 0 {
+		return fmt.Errorf("extension type %d is reserved", typeCode)
+	}
+
+	// Pointers are always encoded as nil or their pointee
+	if goType == nil || goType.Kind() == reflect.Ptr {
+		return fmt.Errorf("cannot register pointer or nil type as an extension")
+	}
+
+	// time.Time always uses the msgpack timestamp extension
+	if goType == timeType {
+		return fmt.Errorf("cannot register %s as an extension", goType)
+	}
+
+	if encode == nil || decode == nil {
+		return fmt.Errorf("extension type %d requires an encoder and decoder", typeCode)
+	}
+
+	// Ensure lengths won't cause problems for 32-bit system ints
+	err := checkMaxLength(0, maxLen)
+	if err != nil {
+		return err
+	}
+
+	extRegistry.Lock()
+	defer extRegistry.Unlock()
+
+	// Each type code and Go type can only have one registration, otherwise
+	// values would have more than one encoding
+	if _, ok := extRegistry.byCode[typeCode]; ok {
+		return fmt.Errorf("extension type %d already registered", typeCode)
+	}
+	if _, ok := extRegistry.byType[goType]; ok {
+		return fmt.Errorf("%s already registered as an extension", goType)
+	}
+
+	et := &extType{
+		typeCode: typeCode,
+		goType:   goType,
+		maxLen:   maxLen,
+		encode:   encode,
+		decode:   decode,
+	}
+	extRegistry.byCode[typeCode] = et
+	extRegistry.byType[goType] = et
+
+	// Compiled plans may have decided goType has no extension
+	clearPlanCache()
+
+	return nil
+}
+
+// lookupExt returns the registered extension type for t, if any
+func lookupExt(t reflect.Type) (*extType, bool) {
+	extRegistry.RLock()
+	defer extRegistry.RUnlock()
+
+	et, ok := extRegistry.byType[t]
+	return et, ok
+}
+
+// encodeExt converts v, which must have the extension's Go type, to a PackExt
+func (et *extType) encodeExt(v reflect.Value) (PackExt, error) {
+	data, err := et.encode(v.Interface())
+	if err != nil {
+		return PackExt{}, err
+	}
+
+	// Refuse to encode something we wouldn't be able to decode
+	if uint64(len(data)) > uint64(et.maxLen) {
+		return PackExt{}, fmt.Errorf("extension data of length %d too long for %s, max is %d", len(data), et.goType, et.maxLen)
+	}
+
+	return PackExt{
+		Type: et.typeCode,
+		Data: data,
+	}, nil
+}
+
+// decodeExt decodes a PackExt from data and converts it to a value of the
+// extension's Go type, which is stored in v
+func (et *extType) decodeExt(data io.Reader, v reflect.Value) error {
+	// Decode the extension, enforcing the registered max length
+	pe, err := decodePackExt(data, et.maxLen)
+	if err != nil {
+		return err
+	}
+
+	// Ensure we got the expected type code
+	if pe.Type != et.typeCode {
+		return fmt.Errorf("got extension type %d, wanted %d", pe.Type, et.typeCode)
+	}
+
+	// Convert to the Go type
+	dec, err := et.decode(pe.Data)
+	if err != nil {
+		return err
+	}
+	dv := reflect.ValueOf(dec)
+	if !dv.IsValid() || dv.Type() != et.goType {
+		return fmt.Errorf("extension decoder returned %T, wanted %s", dec, et.goType)
+	}
+
+	// Decoders often accept more than one form of the same value, so ensure
+	// that encoding again gives back what was on the wire
+	reenc, err := et.encode(dec)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(reenc, pe.Data) {
+		return fmt.Errorf("got non-canonical encoding of %s", et.goType)
+	}
+
+	v.Set(dv)
+	return nil
+}
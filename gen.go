@@ -0,0 +1,266 @@
+package ezpack
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/justicz/ezpack/internal/genhooks"
+)
+
+// The code in this file supports code generated by ezpackgen. Generated code
+// reaches it through package genhelp, so none of it is exported here.
+
+// generatedEncoder and generatedDecoder are implemented by structs with code
+// generated by ezpackgen. Encode and Decode use them in place of reflection.
+// Generated code always produces a canonical map, so unlike Marshaler its
+// output isn't checked
+type generatedEncoder interface {
+	EncodeEzpack(es genhooks.EncodeState) (*PackMap, error)
+}
+
+type generatedDecoder interface {
+	DecodeEzpack(ds genhooks.DecodeState, r io.Reader) error
+}
+
+var (
+	generatedEncoderType = reflect.TypeOf((*generatedEncoder)(nil)).Elem()
+	generatedDecoderType = reflect.TypeOf((*generatedDecoder)(nil)).Elem()
+)
+
+// EzpackEncodeState implements genhooks.EncodeState
+func (es *encodeState) EzpackEncodeState() {}
+
+// EzpackDecodeState implements genhooks.DecodeState
+func (ds *decodeState) EzpackDecodeState() {}
+
+// generatedTypes caches hasGeneratedCode for each struct type we have seen
+var generatedTypes = struct {
+	sync.RWMutex
+	types map[reflect.Type]bool
+}{
+	types: make(map[reflect.Type]bool),
+}
+
+// hasGeneratedCode reports whether the struct type t has code generated by
+// ezpackgen, which means both methods, and generated code isn't disabled
+func hasGeneratedCode(t reflect.Type) bool {
+	if atomic.LoadInt32(&genhooks.Disabled) != 0 {
+		return false
+	}
+
+	generatedTypes.RLock()
+	has, ok := generatedTypes.types[t]
+	generatedTypes.RUnlock()
+
+	if !ok {
+		has = t.Implements(generatedEncoderType) && reflect.PtrTo(t).Implements(generatedDecoderType)
+
+		generatedTypes.Lock()
+		generatedTypes.types[t] = has
+		generatedTypes.Unlock()
+	}
+
+	return has
+}
+
+// generatedEncoderFor returns v as a generatedEncoder if its type has code
+// generated by ezpackgen
+func generatedEncoderFor(v reflect.Value) (generatedEncoder, bool) {
+	if !v.CanInterface() || !hasGeneratedCode(v.Type()) {
+		return nil, false
+	}
+
+	// The generated method has a value receiver
+	return v.Interface().(generatedEncoder), true
+}
+
+// generatedDecoderFor returns v as a generatedDecoder if its type has code
+// generated by ezpackgen. v must be addressable, since the generated method has
+// a pointer receiver
+func generatedDecoderFor(v reflect.Value) (generatedDecoder, bool) {
+	if !v.CanAddr() || !v.CanInterface() || !hasGeneratedCode(v.Type()) {
+		return nil, false
+	}
+
+	return v.Addr().Interface().(generatedDecoder), true
+}
+
+func init() {
+	genhooks.ParseTag = genParseTag
+	genhooks.EncodeField = genEncodeField
+	genhooks.DecodeField = genDecodeField
+	genhooks.ReadStructHeader = genReadStructHeader
+	genhooks.ReadFieldName = genReadFieldName
+	genhooks.ReadUint = genReadUint
+	genhooks.ReadInt = genReadInt
+	genhooks.ReadBool = decodeBool
+	genhooks.ReadString = decodeString
+	genhooks.ReadBytes = decodeByteSlice
+}
+
+// genParseTag implements genhelp.ParseTag
+func genParseTag(tag string, goFieldName string) (genhooks.TagInfo, error) {
+	st := reflect.StructTag(tag)
+	if st.Get("ezpack") == "-" {
+		return genhooks.TagInfo{
+			Skip: true,
+		}, nil
+	}
+
+	ezst, err := parseStructTag(st, goFieldName)
+	if err != nil {
+		return genhooks.TagInfo{}, err
+	}
+
+	plain := ezPackStructTag{
+		FieldName: ezst.FieldName,
+		MaxLen:    ezst.MaxLen,
+	}
+	return genhooks.TagInfo{
+		Name:       ezst.FieldName,
+		MaxLen:     ezst.MaxLen,
+		Inline:     ezst.Inline,
+		HasOptions: ezst != plain,
+	}, nil
+}
+
+// fieldTagCache holds the parsed form of each tag passed to genEncodeField or
+// genDecodeField, so generated code doesn't parse tags on every call
+var fieldTagCache = struct {
+	sync.RWMutex
+	tags map[string]ezPackStructTag
+}{
+	tags: make(map[string]ezPackStructTag),
+}
+
+// parseFieldTag parses a tag passed to genEncodeField or genDecodeField
+func parseFieldTag(tag string) (ezPackStructTag, error) {
+	fieldTagCache.RLock()
+	ezst, ok := fieldTagCache.tags[tag]
+	fieldTagCache.RUnlock()
+	if ok {
+		return ezst, nil
+	}
+
+	ezst, err := parseStructTag(reflect.StructTag(tag), "")
+	if err != nil {
+		return ezPackStructTag{}, err
+	}
+
+	fieldTagCache.Lock()
+	fieldTagCache.tags[tag] = ezst
+	fieldTagCache.Unlock()
+
+	return ezst, nil
+}
+
+// genEncodeField implements genhelp.EncodeField. es comes from the generated
+// EncodeEzpack method, so cycles through generated code are still detected
+func genEncodeField(es genhooks.EncodeState, ptr interface{}, tag string) (interface{}, error) {
+	ezst, err := parseFieldTag(tag)
+	if err != nil {
+		return nil, err
+	}
+
+	v := reflect.ValueOf(ptr)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return nil, fmt.Errorf("EncodeField requires non-nil pointer, not %s", v.Kind())
+	}
+
+	return valueToPackValue(v.Elem(), ezst, es.(*encodeState))
+}
+
+// genDecodeField implements genhelp.DecodeField. ds comes from the generated
+// DecodeEzpack method, so nesting through generated code is still bounded
+func genDecodeField(ds genhooks.DecodeState, r io.Reader, ptr interface{}, tag string) error {
+	ezst, err := parseFieldTag(tag)
+	if err != nil {
+		return err
+	}
+
+	v := reflect.ValueOf(ptr)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("DecodeField requires non-nil pointer, not %s", v.Kind())
+	}
+
+	return decodeValue(r, v.Elem(), ezst, ds.(*decodeState))
+}
+
+// genReadStructHeader implements genhelp.ReadStructHeader
+func genReadStructHeader(r io.Reader, typeName string, numFields uint32) error {
+	mapLen, err := decodeCommonHeader(r, PackMapID)
+	if err != nil {
+		return err
+	}
+
+	if mapLen != numFields {
+		return fmt.Errorf("got wrong map size for struct %s when decoding map", typeName)
+	}
+
+	return nil
+}
+
+// genReadFieldName implements genhelp.ReadFieldName
+func genReadFieldName(r io.Reader, name string) error {
+	allegedName, err := decodeString(r, maxTagFieldNameLength)
+	if err != nil {
+		return err
+	}
+
+	if allegedName != name {
+		return fmt.Errorf("got unexpected field name on wire, wanted %s", name)
+	}
+
+	return nil
+}
+
+// kindBits returns the width in bits of an integer kind
+func kindBits(kind reflect.Kind) uint {
+	switch kind {
+	case reflect.Int8, reflect.Uint8:
+		return 8
+	case reflect.Int16, reflect.Uint16:
+		return 16
+	case reflect.Int32, reflect.Uint32:
+		return 32
+	case reflect.Int, reflect.Uint:
+		return strconv.IntSize
+	default:
+		return 64
+	}
+}
+
+// genReadUint implements genhelp.ReadUint
+func genReadUint(r io.Reader, kind reflect.Kind) (uint64, error) {
+	dec, err := decodeUint64(r)
+	if err != nil {
+		return 0, err
+	}
+
+	if bits := kindBits(kind); bits < 64 && dec>>bits != 0 {
+		return 0, fmt.Errorf("value %d overflows %s", dec, kind)
+	}
+
+	return dec, nil
+}
+
+// genReadInt implements genhelp.ReadInt
+func genReadInt(r io.Reader, kind reflect.Kind) (int64, error) {
+	dec, err := decodeInt64(r)
+	if err != nil {
+		return 0, err
+	}
+
+	if bits := kindBits(kind); bits < 64 {
+		shift := 64 - bits
+		if (dec<<shift)>>shift != dec {
+			return 0, fmt.Errorf("value %d overflows %s", dec, kind)
+		}
+	}
+
+	return dec, nil
+}
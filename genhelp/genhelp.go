@@ -0,0 +1,96 @@
+// Package genhelp is used by code generated by ezpackgen. It gives generated
+// code the same checks and errors as ezpack's reflection-based codec. Nothing
+// else should need it
+package genhelp
+
+import (
+	"io"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/justicz/ezpack"
+	"github.com/justicz/ezpack/internal/genhooks"
+)
+
+// EncodeState is the state of a single call to ezpack.Encode, passed through
+// generated EncodeEzpack methods
+type EncodeState = genhooks.EncodeState
+
+// DecodeState is the state of a single call to ezpack.Decode, passed through
+// generated DecodeEzpack methods
+type DecodeState = genhooks.DecodeState
+
+// TagInfo describes a parsed struct tag
+type TagInfo = genhooks.TagInfo
+
+// ParseTag parses the struct tag (e.g. `ezpack:"name,16"`) on the field named
+// goFieldName, reporting the same errors as ezpack.Encode and ezpack.Decode
+// would
+func ParseTag(tag string, goFieldName string) (TagInfo, error) {
+	return genhooks.ParseTag(tag, goFieldName)
+}
+
+// EncodeField converts the value ptr points to into a PackValue, as if it were
+// a struct field with the given struct tag. Taking a pointer keeps the field's
+// static type, which matters for interface fields
+func EncodeField(es EncodeState, ptr interface{}, tag string) (ezpack.PackValue, error) {
+	pv, err := genhooks.EncodeField(es, ptr, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return pv.(ezpack.PackValue), nil
+}
+
+// DecodeField decodes a value from r into the value ptr points to, as if it
+// were a struct field with the given struct tag
+func DecodeField(ds DecodeState, r io.Reader, ptr interface{}, tag string) error {
+	return genhooks.DecodeField(ds, r, ptr, tag)
+}
+
+// ReadStructHeader reads the map header of a struct named typeName, which must
+// have numFields entries
+func ReadStructHeader(r io.Reader, typeName string, numFields uint32) error {
+	return genhooks.ReadStructHeader(r, typeName, numFields)
+}
+
+// ReadFieldName reads a struct field name, which must be name
+func ReadFieldName(r io.Reader, name string) error {
+	return genhooks.ReadFieldName(r, name)
+}
+
+// ReadUint reads an unsigned integer, which must fit in kind
+func ReadUint(r io.Reader, kind reflect.Kind) (uint64, error) {
+	return genhooks.ReadUint(r, kind)
+}
+
+// ReadInt reads a signed integer, which must fit in kind
+func ReadInt(r io.Reader, kind reflect.Kind) (int64, error) {
+	return genhooks.ReadInt(r, kind)
+}
+
+// ReadBool reads a bool
+func ReadBool(r io.Reader) (bool, error) {
+	return genhooks.ReadBool(r)
+}
+
+// ReadString reads a string of at most maxLen bytes
+func ReadString(r io.Reader, maxLen uint32) (string, error) {
+	return genhooks.ReadString(r, maxLen)
+}
+
+// ReadBytes reads a byte slice of at most maxLen bytes
+func ReadBytes(r io.Reader, maxLen uint32) ([]byte, error) {
+	return genhooks.ReadBytes(r, maxLen)
+}
+
+// WithReflection runs f with generated code disabled, so that everything f
+// encodes or decodes goes through reflection. Generated tests use it to check
+// that the generated code agrees with reflection. It affects every goroutine
+// while f runs, but only changes how values are encoded, not the result
+func WithReflection(f func()) {
+	atomic.AddInt32(&genhooks.Disabled, 1)
+	defer atomic.AddInt32(&genhooks.Disabled, -1)
+
+	f()
+}
@@ -0,0 +1,60 @@
+// Package genhooks connects package genhelp to the internals of package
+// ezpack, so that ezpack doesn't have to export anything only generated code
+// needs. ezpack fills in the functions when it is initialized
+package genhooks
+
+import (
+	"io"
+	"reflect"
+)
+
+// EncodeState is the state of a single call to Encode, which generated code
+// passes back to ezpack so that pointer cycles are still detected. Only ezpack
+// implements it
+type EncodeState interface {
+	EzpackEncodeState()
+}
+
+// DecodeState is the state of a single call to Decode, which generated code
+// passes back to ezpack so that the nesting depth is still bounded. Only
+// ezpack implements it
+type DecodeState interface {
+	EzpackDecodeState()
+}
+
+// TagInfo describes a parsed struct tag
+type TagInfo struct {
+	// Name is the field name on the wire
+	Name string
+
+	// MaxLen is the max length given in the tag, or 0
+	MaxLen uint32
+
+	// Skip is true if the field is tagged with "-"
+	Skip bool
+
+	// Inline is true if the field is an embedded struct to be flattened
+	Inline bool
+
+	// HasOptions is true if the tag has any options besides the name and max
+	// length
+	HasOptions bool
+}
+
+// Disabled is nonzero while generated code should be ignored in favor of
+// reflection. It must be accessed atomically
+var Disabled int32
+
+// These are documented by the functions of the same names in genhelp
+var (
+	ParseTag         func(tag string, goFieldName string) (TagInfo, error)
+	EncodeField      func(es EncodeState, ptr interface{}, tag string) (interface{}, error)
+	DecodeField      func(ds DecodeState, r io.Reader, ptr interface{}, tag string) error
+	ReadStructHeader func(r io.Reader, typeName string, numFields uint32) error
+	ReadFieldName    func(r io.Reader, name string) error
+	ReadUint         func(r io.Reader, kind reflect.Kind) (uint64, error)
+	ReadInt          func(r io.Reader, kind reflect.Kind) (int64, error)
+	ReadBool         func(r io.Reader) (bool, error)
+	ReadString       func(r io.Reader, maxLen uint32) (string, error)
+	ReadBytes        func(r io.Reader, maxLen uint32) ([]byte, error)
+)
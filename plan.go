@@ -0,0 +1,151 @@
+package ezpack
+
+import (
+	"io"
+	"reflect"
+	"sync"
+)
+
+// fieldPlan holds everything needed to encode or decode one struct field
+type fieldPlan struct {
+	parsedStructField
+
+	// goName is the name of the field in the Go struct, for error messages
+	goName string
+
+	// encode and decode are chosen once for the field's type. They skip the
+	// checks for extension types and marshaling interfaces when the type can't
+	// have them
+	encode func(v reflect.Value, es *encodeState) (PackValue, error)
+	decode func(data io.Reader, v reflect.Value, ds *decodeState) error
+}
+
+// structPlan is the compiled plan for encoding and decoding a struct type: its
+// fields sorted by name on the wire, or the schema error found while sorting
+// them
+type structPlan struct {
+	fields []fieldPlan
+	err    error
+}
+
+// planCache holds the compiled plan for each struct type we have seen. gen is
+// bumped every time the cache is cleared, so that plans compiled before then
+// aren't stored
+var planCache = struct {
+	sync.RWMutex
+	plans map[reflect.Type]*structPlan
+	gen   uint64
+}{
+	plans: make(map[reflect.Type]*structPlan),
+}
+
+// planFor returns the compiled plan for the struct type t, compiling it if
+// this is the first time we've seen t. Schema errors are cached too, so they
+// are reported the same way every time
+func planFor(t reflect.Type) ([]fieldPlan, error) {
+	planCache.RLock()
+	plan, ok := planCache.plans[t]
+	gen := planCache.gen
+	planCache.RUnlock()
+
+	if !ok {
+		// Compile outside the lock. If another goroutine compiles t at the same
+		// time, both plans are equivalent so it doesn't matter which one is kept
+		plan = compilePlan(t)
+
+		storePlan(t, plan, gen)
+	}
+
+	return plan.fields, plan.err
+}
+
+// storePlan caches plan for t, unless the cache has been cleared since gen.
+// In that case the plan may be stale (e.g. missing an extension registered
+// while it was compiled). It's still fine for the call that compiled it, which
+// raced with the registration, but it must not be kept
+func storePlan(t reflect.Type, plan *structPlan, gen uint64) {
+	planCache.Lock()
+	if planCache.gen == gen {
+		planCache.plans[t] = plan
+	}
+	planCache.Unlock()
+}
+
+// clearPlanCache forgets every compiled plan. This must be called whenever
+// something that compilePlan depends on changes, e.g. registering an
+// extension, and only after the change is visible to compilePlan
+func clearPlanCache() {
+	planCache.Lock()
+	planCache.plans = make(map[reflect.Type]*structPlan)
+	planCache.gen++
+	planCache.Unlock()
+}
+
+// compilePlan builds the plan for the struct type t
+func compilePlan(t reflect.Type) *structPlan {
+	parsedFields, err := sortStructFields(t)
+	if err != nil {
+		return &structPlan{
+			err: err,
+		}
+	}
+
+	fields := make([]fieldPlan, 0, len(parsedFields))
+	for _, parsedField := range parsedFields {
+		structField := t.FieldByIndex(parsedField.index)
+		ezst := parsedField.parsedStructTag
+
+		fp := fieldPlan{
+			parsedStructField: parsedField,
+			goName:            structField.Name,
+		}
+		if hasCodecHooks(structField.Type, ezst) {
+			fp.encode = func(v reflect.Value, es *encodeState) (PackValue, error) {
+				return valueToPackValue(v, ezst, es)
+			}
+			fp.decode = func(data io.Reader, v reflect.Value, ds *decodeState) error {
+				return decodeValue(data, v, ezst, ds)
+			}
+		} else {
+			fp.encode = func(v reflect.Value, es *encodeState) (PackValue, error) {
+				return kindToPackValue(v, ezst, es)
+			}
+			fp.decode = func(data io.Reader, v reflect.Value, ds *decodeState) error {
+				return decodeKind(data, v, ezst, ds)
+			}
+		}
+
+		fields = append(fields, fp)
+	}
+
+	return &structPlan{
+		fields: fields,
+	}
+}
+
+// hasCodecHooks returns true if values of type t in a field tagged with ezst
+// might be encoded other than according to their kind, because of a tag
+// option, a registered extension or a marshaling interface
+func hasCodecHooks(t reflect.Type, ezst ezPackStructTag) bool {
+	// Pointers are always encoded according to their kind, and their pointees
+	// are checked separately
+	if t.Kind() == reflect.Ptr {
+		return false
+	}
+
+	if ezst.Binary || ezst.Text {
+		return true
+	}
+
+	if _, ok := lookupExt(t); ok {
+		return true
+	}
+
+	for _, iface := range []reflect.Type{marshalerType, unmarshalerType} {
+		if t.Implements(iface) || reflect.PtrTo(t).Implements(iface) {
+			return true
+		}
+	}
+
+	return false
+}
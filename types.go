@@ -1,21 +1,98 @@
 package ezpack
 
+import "io"
+
+const (
+	PackMapID     = 0xDF
+	PackUint64ID  = 0xCF
+	PackInt64ID   = 0xD3
+	PackBytesID   = 0xC6
+	PackStringID  = 0xDB
+	PackArrayID   = 0xDD
+	PackFalseID   = 0xC2
+	PackTrueID    = 0xC3
+	PackFloat32ID = 0xCA
+	PackFloat64ID = 0xCB
+	PackNilID     = 0xC0
+	PackExt8ID    = 0xC7
+	PackExt32ID   = 0xC9
+)
+
+// Timestamps are encoded with the msgpack timestamp extension type, always
+// using the 96-bit format: a 4 byte nanoseconds field followed by an 8 byte
+// signed seconds field
+const (
+	PackTimestampExtType = -1
+	PackTimestampLen     = 12
+)
+
+// Canonical bit patterns for NaN. Any NaN is encoded using these patterns, and
+// any other NaN payload is rejected when decoding
 const (
-	PackMapID    = 0xDF
-	PackUint64ID = 0xCF
-	PackBytesID  = 0xC6
-	PackStringID = 0xDB
-	PackArrayID  = 0xDD
+	CanonicalNaN32 = 0x7FC00000
+	CanonicalNaN64 = 0x7FF8000000000000
+)
+
+// Sign bytes for big.Int values, which are encoded as bin holding the sign byte
+// followed by the minimal big endian magnitude (with no leading zero bytes)
+const (
+	BigIntNonNegative = 0x00
+	BigIntNegative    = 0x01
 )
 
 type PackValue interface {
 	Encode() ([]byte, error)
+	EncodeTo(w io.Writer) error
+	AppendTo(dst []byte) ([]byte, error)
+	Size() (int, error)
+}
+
+// Marshaler is implemented by types that convert themselves to a PackValue
+// when encoding, instead of being encoded according to their kind. The
+// returned value must be canonical (e.g. map keys sorted) or encoding fails
+type Marshaler interface {
+	MarshalEzpack() (PackValue, error)
+}
+
+// Unmarshaler is implemented by types that convert themselves from a
+// PackValue when decoding. The PackValue has already been checked against
+// the limits in the field's struct tag
+type Unmarshaler interface {
+	UnmarshalEzpack(PackValue) error
 }
 
+type PackNil struct{}
+
 type PackUint64 struct {
 	Value uint64
 }
 
+type PackInt64 struct {
+	Value int64
+}
+
+type PackBool struct {
+	Value bool
+}
+
+type PackFloat32 struct {
+	Value float32
+}
+
+type PackFloat64 struct {
+	Value float64
+}
+
+type PackTimestamp struct {
+	Seconds     int64
+	Nanoseconds uint32
+}
+
+type PackExt struct {
+	Type int8
+	Data []byte
+}
+
 type PackBytes struct {
 	Bytes []byte
 }
@@ -0,0 +1,109 @@
+package ezpack
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sync"
+)
+
+// UnknownVariantError is returned when decoding a union whose variant name on
+// the wire is not registered for the union's interface type
+type UnknownVariantError struct {
+	Interface reflect.Type
+	Name      string
+}
+
+func (e *UnknownVariantError) Error() string {
+	return fmt.Sprintf("unknown variant '%s' for union %s", e.Name, e.Interface)
+}
+
+// unionType holds the registered variants of an interface type
+type unionType struct {
+	iface  reflect.Type
+	byName map[string]reflect.Type
+	byType map[reflect.Type]string
+}
+
+// unionRegistry holds the registered union types, looked up by interface type
+var unionRegistry = struct {
+	sync.RWMutex
+	byIface map[reflect.Type]*unionType
+}{
+	byIface: make(map[reflect.Type]*unionType),
+}
+
+// variantNameRegex matches valid variant names, which follow the same rules as
+// field names in struct tags
+var variantNameRegex = regexp.MustCompile(`^\w+$`)
+
+// RegisterUnion registers the concrete types that may be stored in interface
+// fields of type ifaceType tagged with the union option, keyed by the name
+// that identifies each on the wire. Variants must be structs or pointers to
+// structs, and each interface type may only be registered once
+func RegisterUnion(ifaceType reflect.Type, variants map[string]reflect.Type) error {
+	if ifaceType == nil || ifaceType.Kind() != reflect.Interface {
+		return fmt.Errorf("can only register interface types as unions")
+	}
+
+	ut := &unionType{
+		iface:  ifaceType,
+		byName: make(map[string]reflect.Type, len(variants)),
+		byType: make(map[reflect.Type]string, len(variants)),
+	}
+	for name, variant := range variants {
+		// Check that the name is one we can encode
+		if !variantNameRegex.MatchString(name) || len(name) > maxTagFieldNameLength {
+			return fmt.Errorf("invalid variant name '%s' for union %s", name, ifaceType)
+		}
+
+		// Check that the variant is a struct or a pointer to one
+		if variant == nil {
+			return fmt.Errorf("variant '%s' of union %s is nil", name, ifaceType)
+		}
+		st := variant
+		if st.Kind() == reflect.Ptr {
+			st = st.Elem()
+		}
+		if st.Kind() != reflect.Struct {
+			return fmt.Errorf("variant '%s' of union %s must be a struct or pointer to struct", name, ifaceType)
+		}
+
+		// Check that the variant can be stored in the interface
+		if !variant.Implements(ifaceType) {
+			return fmt.Errorf("variant '%s' does not implement %s", name, ifaceType)
+		}
+
+		// Each variant must have exactly one name, so that each value has
+		// exactly one encoding
+		if other, ok := ut.byType[variant]; ok {
+			return fmt.Errorf("%s registered as both '%s' and '%s' in union %s", variant, other, name, ifaceType)
+		}
+
+		ut.byName[name] = variant
+		ut.byType[variant] = name
+	}
+
+	unionRegistry.Lock()
+	defer unionRegistry.Unlock()
+
+	if _, ok := unionRegistry.byIface[ifaceType]; ok {
+		return fmt.Errorf("union %s already registered", ifaceType)
+	}
+	unionRegistry.byIface[ifaceType] = ut
+
+	return nil
+}
+
+// lookupUnion returns the registered union type for the interface type t
+func lookupUnion(t reflect.Type) (*unionType, error) {
+	unionRegistry.RLock()
+	defer unionRegistry.RUnlock()
+
+	ut, ok := unionRegistry.byIface[t]
+	if !ok {
+		return nil, fmt.Errorf("union %s not registered", t)
+	}
+
+	return ut, nil
+}